@@ -0,0 +1,229 @@
+package backfill
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/evolutionlandorg/block-scan/metrics"
+	"github.com/evolutionlandorg/block-scan/scan"
+	"github.com/evolutionlandorg/block-scan/services"
+	"github.com/evolutionlandorg/block-scan/util/log"
+)
+
+// Backfill scans the fixed range ScanEventsOptions.Backfill with several workers and returns
+// once the range is done. Ranges are fetched in parallel but delivered in block order, and the
+// backfill checkpoint only moves past a range once it and every range before it are delivered.
+// The live checkpoint of the chain is never read or moved.
+type Backfill struct {
+	*scan.Polling
+	metrics metrics.Metrics
+}
+
+type chunk struct {
+	index    int
+	from, to uint64
+}
+
+type fetched struct {
+	txn     services.Tnx
+	receipt *services.Receipts
+}
+
+type result struct {
+	chunk chunk
+	txs   []fetched
+	err   error
+}
+
+func (b *Backfill) SetMetrics(metrics metrics.Metrics) {
+	b.metrics = metrics
+	if b.Polling != nil {
+		b.Polling.SetMetrics(metrics)
+	}
+}
+
+func (b *Backfill) Init(opt services.ScanEventsOptions) error {
+	if b.Polling == nil {
+		b.Polling = new(scan.Polling)
+		b.Polling.SetMetrics(b.metrics)
+	}
+	if opt.Backfill.To == 0 || opt.Backfill.From > opt.Backfill.To {
+		return fmt.Errorf("invalid backfill range %d-%d", opt.Backfill.From, opt.Backfill.To)
+	}
+	if opt.Backfill.Workers <= 0 {
+		opt.Backfill.Workers = 4
+	}
+	if opt.Backfill.ChunkSize == 0 {
+		opt.Backfill.ChunkSize = 100
+	}
+	if opt.Backfill.GetStartBlock == nil && opt.Backfill.SetStartBlock == nil {
+		if opt.CheckpointStore != nil {
+			key := fmt.Sprintf("%s:backfill:%d-%d", opt.Chain, opt.Backfill.From, opt.Backfill.To)
+			opt.Backfill.GetStartBlock, opt.Backfill.SetStartBlock = services.CheckpointFuncs(opt.CheckpointStore, key)
+		} else {
+			var checkpoint atomic.Uint64
+			opt.Backfill.GetStartBlock, opt.Backfill.SetStartBlock = checkpoint.Load, checkpoint.Store
+		}
+	}
+	if opt.Backfill.GetStartBlock == nil || opt.Backfill.SetStartBlock == nil {
+		return errors.New("backfill GetStartBlock and SetStartBlock must be set together")
+	}
+	return b.Polling.Init(opt)
+}
+
+func (b *Backfill) WipeBlock(ctx context.Context) error {
+	var (
+		bf   = b.Opt.Backfill
+		from = bf.From
+	)
+	// resume at the backfill checkpoint, the first block that is not done, if it is inside the range
+	if next := bf.GetStartBlock(); next > bf.From {
+		if next > bf.To {
+			log.Info("%s backfill %d-%d already done", b.Opt.Chain, bf.From, bf.To)
+			return nil
+		}
+		from = next
+	}
+	head, err := b.Opt.ChainIoV2.BlockNumber(ctx)
+	if err != nil {
+		return err
+	}
+	if head = b.Opt.ConfirmedHead(head); head < bf.To {
+		return fmt.Errorf("%s backfill range ends at %d after confirmed chain head %d", b.Opt.Chain, bf.To, head)
+	}
+	log.Info("%s start backfill %d-%d with %d workers", b.Opt.Chain, from, bf.To, bf.Workers)
+
+	ctx, cancel := context.WithCancel(services.WithPriority(ctx, services.PriorityBackfill))
+	defer cancel()
+
+	var (
+		jobs    = make(chan chunk)
+		results = make(chan result)
+		// tokens bounds the number of fetched ranges waiting to be delivered
+		tokens = make(chan struct{}, bf.Workers*2)
+		wg     sync.WaitGroup
+	)
+	go func() {
+		defer close(jobs)
+		index := 0
+		for start := from; start <= bf.To; start += bf.ChunkSize {
+			end := start + bf.ChunkSize - 1
+			if end > bf.To {
+				end = bf.To
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case tokens <- struct{}{}:
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case jobs <- chunk{index: index, from: start, to: end}:
+			}
+			index++
+		}
+	}()
+	for i := 0; i < bf.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range jobs {
+				txs, err := b.fetch(ctx, c)
+				select {
+				case <-ctx.Done():
+					return
+				case results <- result{chunk: c, txs: txs, err: err}:
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var (
+		next    int
+		pending = make(map[int]result)
+	)
+	for r := range results {
+		if r.err != nil {
+			return r.err
+		}
+		pending[r.chunk.index] = r
+		for {
+			r, ok := pending[next]
+			if !ok {
+				break
+			}
+			if err := b.HandleControl(ctx); err != nil {
+				return nil
+			}
+			for _, v := range r.txs {
+				if err := b.Retry(ctx, func() error { return b.Deliver(ctx, v.txn, v.receipt) }); err != nil {
+					if ctx.Err() != nil {
+						return nil
+					}
+					return err
+				}
+			}
+			bf.SetStartBlock(r.chunk.to + 1)
+			b.Opt.Control.SetProgress(r.chunk.to)
+			delete(pending, next)
+			next++
+			<-tokens
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	log.Info("%s backfill %d-%d done", b.Opt.Chain, bf.From, bf.To)
+	return nil
+}
+
+// fetch collects the transactions and receipts of a range in block order.
+func (b *Backfill) fetch(ctx context.Context, c chunk) ([]fetched, error) {
+	var (
+		txs             []fetched
+		filterContracts []string
+	)
+	for k := range b.Opt.ContractsName {
+		filterContracts = append(filterContracts, k.String())
+	}
+	for i := c.from; i <= c.to; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var trans *services.BlockTrans
+		if err := b.Retry(ctx, func() (err error) {
+			trans, err = b.Opt.ChainIoV2.FilterTrans(ctx, i, filterContracts)
+			return err
+		}); err != nil {
+			return nil, fmt.Errorf("%s backfill block %d: %w", b.Opt.Chain, i, err)
+		}
+		txns := make([]services.Tnx, len(trans.Txn))
+		for index, txID := range trans.Txn {
+			txns[index] = services.Tnx{Tx: txID, BlockTimestamp: trans.Timestamp, Contract: trans.Contracts[index], SkipCheckpoint: true}
+		}
+		receipts, errs := b.FetchReceipts(ctx, txns)
+		for index, txn := range txns {
+			receipt := receipts[index]
+			if errs[index] != nil {
+				if err := b.Retry(ctx, func() (err error) {
+					receipt, err = b.FetchReceipt(ctx, txn)
+					return err
+				}); err != nil {
+					return nil, fmt.Errorf("%s backfill block %d tx %s: %w", b.Opt.Chain, i, txn.Tx, err)
+				}
+			}
+			if receipt != nil {
+				txs = append(txs, fetched{txn: txn, receipt: receipt})
+			}
+		}
+	}
+	return txs, nil
+}
@@ -0,0 +1,133 @@
+package backfill
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/evolutionlandorg/block-scan/checkpoint"
+	"github.com/evolutionlandorg/block-scan/metrics"
+	"github.com/evolutionlandorg/block-scan/services"
+	"github.com/stretchr/testify/assert"
+)
+
+type chainIo struct{}
+
+func (c *chainIo) ReceiptLog(tx string) (*services.Receipts, error) {
+	var blockNum uint64
+	_, _ = fmt.Sscanf(tx, "0x%d", &blockNum)
+	return &services.Receipts{
+		BlockNumber: fmt.Sprint(blockNum),
+		Logs:        []services.Log{{Topics: []string{"0x1"}, Data: tx, Address: "0x222"}},
+		Status:      "0x1",
+		ChainSource: "Crab",
+	}, nil
+}
+
+func (c *chainIo) BlockNumber() uint64 {
+	return 1000
+}
+
+func (c *chainIo) FilterTrans(blockNum uint64, _ []string) ([]string, []string, uint64, []string) {
+	time.Sleep(time.Duration(rand.Intn(100)) * time.Microsecond)
+	if blockNum%3 != 0 {
+		return nil, nil, 0, nil
+	}
+	return []string{fmt.Sprintf("0x%d", blockNum)}, []string{"0x222"}, blockNum, []string{"0x222"}
+}
+
+func (c *chainIo) BlockHeader(blockNum uint64) *services.BlockHeader {
+	return &services.BlockHeader{BlockTimeStamp: blockNum}
+}
+
+func (c *chainIo) GetTransactionStatus(_ string) string {
+	return "0x1"
+}
+
+func TestBackfill(t *testing.T) {
+	var (
+		delivered   []string
+		checkpoints []uint64
+	)
+	run := func(from, to, startBlock uint64) {
+		b := new(Backfill)
+		b.SetMetrics(metrics.NewMetrics())
+		assert.NoError(t, b.Init(services.ScanEventsOptions{
+			ChainIo:       new(chainIo),
+			Chain:         "Crab",
+			GetStartBlock: func() uint64 { return 0 },
+			SetStartBlock: func(uint64) { t.Fatal("live checkpoint moved") },
+			ContractsName: map[services.ContractsAddress]services.ContractsName{"0x222": "fake"},
+			GetCallbackFunc: func(tx string, _ uint64, _ *services.Receipts) interface{} {
+				delivered = append(delivered, tx)
+				return nil
+			},
+			Backfill: services.BackfillOptions{
+				From: from, To: to, Workers: 4, ChunkSize: 20,
+				GetStartBlock: func() uint64 { return startBlock },
+				SetStartBlock: func(blockNum uint64) { checkpoints = append(checkpoints, blockNum) },
+			},
+		}))
+		assert.NoError(t, b.WipeBlock(context.Background()))
+	}
+
+	run(100, 349, 0)
+	var want []string
+	for i := 102; i <= 348; i += 3 {
+		want = append(want, fmt.Sprintf("0x%d", i))
+	}
+	assert.Equal(t, want, delivered)
+	assert.Len(t, checkpoints, 13)
+	for i := 1; i < len(checkpoints)-1; i++ {
+		assert.Equal(t, checkpoints[i-1]+20, checkpoints[i])
+	}
+	assert.Equal(t, uint64(350), checkpoints[len(checkpoints)-1])
+
+	// resume at a checkpoint inside the range
+	delivered, checkpoints = nil, nil
+	run(100, 349, 300)
+	assert.Equal(t, want[len(want)-17:], delivered)
+	assert.Equal(t, []uint64{320, 340, 350}, checkpoints)
+
+	delivered, checkpoints = nil, nil
+	run(100, 349, 350)
+	assert.Empty(t, delivered)
+
+	// block 0 is not done before the backfill starts
+	delivered, checkpoints = nil, nil
+	run(0, 9, 0)
+	assert.Equal(t, []string{"0x0", "0x3", "0x6", "0x9"}, delivered)
+	assert.Equal(t, []uint64{10}, checkpoints)
+}
+
+func TestBackfillLiveCheckpoint(t *testing.T) {
+	var (
+		delivered []string
+		store     = checkpoint.NewMemory()
+	)
+	b := new(Backfill)
+	b.SetMetrics(metrics.NewMetrics())
+	assert.NoError(t, b.Init(services.ScanEventsOptions{
+		ChainIo:         new(chainIo),
+		Chain:           "Crab",
+		CheckpointStore: store,
+		GetStartBlock:   func() uint64 { return 1000 },
+		SetStartBlock:   func(uint64) { t.Fatal("live checkpoint moved") },
+		ContractsName:   map[services.ContractsAddress]services.ContractsName{"0x222": "fake"},
+		GetCallbackFunc: func(tx string, _ uint64, _ *services.Receipts) interface{} {
+			delivered = append(delivered, tx)
+			return nil
+		},
+		Backfill: services.BackfillOptions{From: 100, To: 149, ChunkSize: 20},
+	}))
+	assert.NoError(t, b.WipeBlock(context.Background()))
+	assert.Len(t, delivered, 16)
+	cp, err := store.Load("Crab:backfill:100-149")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(150), cp.BlockNum)
+	cp, err = store.Load("Crab")
+	assert.NoError(t, err)
+	assert.Zero(t, cp.BlockNum)
+}
@@ -0,0 +1,166 @@
+package checkpoint
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/evolutionlandorg/block-scan/services"
+	"github.com/stretchr/testify/assert"
+)
+
+func testStore(t *testing.T, store services.CheckpointStore) {
+	cp, err := store.Load("eth")
+	assert.Nil(t, err)
+	assert.Equal(t, services.Checkpoint{}, cp)
+
+	cp, err = store.Save("eth", services.Checkpoint{BlockNum: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, services.Checkpoint{BlockNum: 10, Version: 1}, cp)
+
+	_, err = store.Save("eth", services.Checkpoint{BlockNum: 11})
+	assert.ErrorIs(t, err, services.ErrCheckpointConflict)
+
+	cp, err = store.Save("eth", services.Checkpoint{BlockNum: 12, Version: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), cp.Version)
+
+	cp, err = store.Load("eth")
+	assert.Nil(t, err)
+	assert.Equal(t, services.Checkpoint{BlockNum: 12, Version: 2}, cp)
+
+	cp, err = store.Load("heco")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), cp.BlockNum)
+}
+
+func TestMemory(t *testing.T) {
+	testStore(t, NewMemory())
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	testStore(t, NewFile(path))
+
+	cp, err := NewFile(path).Load("eth")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(12), cp.BlockNum)
+}
+
+// fakeRedis answers HMGET and the EVAL of saveScript the way redis would, from a single hash.
+// between runs after each command, like another replica would.
+type fakeRedis struct {
+	t       *testing.T
+	hash    map[string]string
+	between func()
+}
+
+func (r *fakeRedis) cache(context.Context) services.CacheFunc {
+	return func(commandName string, args ...interface{}) (interface{}, error) {
+		if r.between != nil {
+			defer r.between()
+		}
+		switch commandName {
+		case "HMGET":
+			assert.Equal(r.t, RedisKey, args[0])
+			var fields []interface{}
+			for _, field := range args[1:] {
+				if v, ok := r.hash[field.(string)]; ok {
+					fields = append(fields, []byte(v))
+				} else {
+					fields = append(fields, nil)
+				}
+			}
+			return fields, nil
+		case "EVAL":
+			assert.Equal(r.t, []interface{}{saveScript, 1, RedisKey}, args[:3])
+			chain := args[3].(string)
+			version, _ := strconv.ParseInt(r.hash[chain+":version"], 10, 64)
+			if fmt.Sprint(version) != fmt.Sprint(args[4]) {
+				return int64(-1), nil
+			}
+			r.hash[chain] = fmt.Sprint(args[5])
+			r.hash[chain+":version"] = fmt.Sprint(version + 1)
+			return version + 1, nil
+		}
+		return nil, fmt.Errorf("unexpected command %s", commandName)
+	}
+}
+
+func TestRedis(t *testing.T) {
+	redis := &fakeRedis{t: t, hash: make(map[string]string)}
+	testStore(t, NewRedis(redis.cache))
+	assert.Equal(t, map[string]string{"eth": "12", "eth:version": "2"}, redis.hash)
+
+	cp, err := NewRedis(redis.cache).Load("eth")
+	assert.Nil(t, err)
+	assert.Equal(t, services.Checkpoint{BlockNum: 12, Version: 2}, cp)
+
+	// a writer with a stale version reloads the checkpoint after the conflict
+	getA, setA := services.CheckpointFuncs(NewRedis(redis.cache), "heco")
+	getB, setB := services.CheckpointFuncs(NewRedis(redis.cache), "heco")
+	assert.Equal(t, uint64(0), getA())
+	assert.Equal(t, uint64(0), getB())
+	setA(100)
+	setB(50)
+	assert.Equal(t, "100", redis.hash["heco"])
+	setB(150)
+	assert.Equal(t, "150", redis.hash["heco"])
+	assert.Equal(t, "2", redis.hash["heco:version"])
+
+	// another replica saves right after each command, Load still pairs a block with its own version
+	other := NewRedis(redis.cache)
+	redis.between = func() {
+		redis.between = nil
+		_, err := other.Save("heco", services.Checkpoint{BlockNum: 200, Version: 2})
+		assert.Nil(t, err)
+	}
+	cp, err = NewRedis(redis.cache).Load("heco")
+	assert.Nil(t, err)
+	assert.Equal(t, services.Checkpoint{BlockNum: 150, Version: 2}, cp)
+	_, err = NewRedis(redis.cache).Save("heco", services.Checkpoint{BlockNum: 150, Version: cp.Version})
+	assert.ErrorIs(t, err, services.ErrCheckpointConflict)
+	assert.Equal(t, "200", redis.hash["heco"])
+}
+
+func TestCheckpointFuncsConflict(t *testing.T) {
+	store := NewMemory()
+	getA, setA := services.CheckpointFuncs(store, "eth")
+	getB, setB := services.CheckpointFuncs(store, "eth")
+	assert.Equal(t, uint64(0), getA())
+	assert.Equal(t, uint64(0), getB())
+
+	setA(100)
+	// B has a stale version and a lower block, A's checkpoint is kept
+	setB(50)
+	assert.Equal(t, uint64(100), getA())
+
+	// B reloaded the version, a higher block goes through
+	setB(150)
+	assert.Equal(t, uint64(150), getA())
+	// A has loaded B's checkpoint, a lower block does not move it back
+	setA(120)
+	assert.Equal(t, uint64(150), getB())
+	// not even A's own checkpoint, once saved
+	setA(160)
+	setA(155)
+	assert.Equal(t, uint64(160), getB())
+}
+
+func TestStoreCheckpointRewind(t *testing.T) {
+	store := NewMemory()
+	a, b := services.NewStoreCheckpoint(store, "eth"), services.NewStoreCheckpoint(store, "eth")
+	a.Set(100)
+	assert.Equal(t, uint64(100), b.Get())
+	b.Set(150)
+
+	// a rewinds on a reorg, with a stale version
+	a.Rewind(90)
+	blockNum, err := b.Load(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(90), blockNum)
+	a.Set(95)
+	assert.Equal(t, uint64(95), b.Get())
+}
@@ -0,0 +1,121 @@
+package checkpoint
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/evolutionlandorg/block-scan/services"
+)
+
+// staleLock is how old a lock file may get before it is considered left behind by a crashed process
+const staleLock = 10 * time.Second
+
+// File keeps the checkpoints of all chains in one JSON file. Every save writes a temporary
+// file and renames it over the old one, so the file is never left half written.
+// Processes sharing the file serialize their saves through a "<path>.lock" file.
+type File struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewFile(path string) *File {
+	return &File{path: path}
+}
+
+func (f *File) Load(chain string) (services.Checkpoint, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	checkpoints, err := f.read()
+	if err != nil {
+		return services.Checkpoint{}, err
+	}
+	return checkpoints[chain], nil
+}
+
+func (f *File) Save(chain string, cp services.Checkpoint) (services.Checkpoint, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	unlock, err := f.lock()
+	if err != nil {
+		return services.Checkpoint{}, err
+	}
+	defer unlock()
+
+	checkpoints, err := f.read()
+	if err != nil {
+		return services.Checkpoint{}, err
+	}
+	if checkpoints[chain].Version != cp.Version {
+		return services.Checkpoint{}, services.ErrCheckpointConflict
+	}
+	cp.Version++
+	checkpoints[chain] = cp
+	return cp, f.write(checkpoints)
+}
+
+func (f *File) read() (map[string]services.Checkpoint, error) {
+	checkpoints := make(map[string]services.Checkpoint)
+	b, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return checkpoints, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &checkpoints); err != nil {
+		return nil, fmt.Errorf("decode checkpoint file %s: %w", f.path, err)
+	}
+	return checkpoints, nil
+}
+
+func (f *File) write(checkpoints map[string]services.Checkpoint) error {
+	b, err := json.MarshalIndent(checkpoints, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+func (f *File) lock() (unlock func(), err error) {
+	name := f.path + ".lock"
+	deadline := time.Now().Add(2 * staleLock)
+	for {
+		l, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err == nil {
+			_ = l.Close()
+			return func() { _ = os.Remove(name) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		if info, err := os.Stat(name); err == nil && time.Since(info.ModTime()) > staleLock {
+			_ = os.Remove(name)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("lock checkpoint file %s: timeout", f.path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,34 @@
+package checkpoint
+
+import (
+	"sync"
+
+	"github.com/evolutionlandorg/block-scan/services"
+)
+
+// Memory keeps checkpoints in process memory. It is meant for tests.
+type Memory struct {
+	mu          sync.Mutex
+	checkpoints map[string]services.Checkpoint
+}
+
+func NewMemory() *Memory {
+	return &Memory{checkpoints: make(map[string]services.Checkpoint)}
+}
+
+func (m *Memory) Load(chain string) (services.Checkpoint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.checkpoints[chain], nil
+}
+
+func (m *Memory) Save(chain string, cp services.Checkpoint) (services.Checkpoint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.checkpoints[chain].Version != cp.Version {
+		return services.Checkpoint{}, services.ErrCheckpointConflict
+	}
+	cp.Version++
+	m.checkpoints[chain] = cp
+	return cp, nil
+}
@@ -0,0 +1,70 @@
+package checkpoint
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/evolutionlandorg/block-scan/services"
+	"github.com/spf13/cast"
+)
+
+// RedisKey is the hash the checkpoints are stored in. Field {chain} holds the block number
+// and field {chain}:version its version.
+const RedisKey = "WipeBlock"
+
+// saveScript compares the version and sets the block number and the next version atomically.
+const saveScript = `
+local version = tonumber(redis.call('HGET', KEYS[1], ARGV[1] .. ':version') or '0')
+if version ~= tonumber(ARGV[2]) then
+	return -1
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[3])
+redis.call('HSET', KEYS[1], ARGV[1] .. ':version', version + 1)
+return version + 1
+`
+
+// Redis keeps checkpoints in a redis hash through a services.CacheFunc.
+// The CacheFunc must accept HMGET and EVAL.
+type Redis struct {
+	cache services.GetCacheFunc
+}
+
+func NewRedis(cache services.GetCacheFunc) *Redis {
+	return &Redis{cache: cache}
+}
+
+// Load reads the block number and its version with one HMGET, so they always belong to the same save.
+func (r *Redis) Load(chain string) (services.Checkpoint, error) {
+	reply, err := r.cache(context.Background())("HMGET", RedisKey, chain, chain+":version")
+	if err != nil {
+		return services.Checkpoint{}, err
+	}
+	fields, ok := reply.([]interface{})
+	if !ok || len(fields) != 2 {
+		return services.Checkpoint{}, fmt.Errorf("unexpected redis reply %v", reply)
+	}
+	return services.Checkpoint{BlockNum: toUint64(fields[0]), Version: toUint64(fields[1])}, nil
+}
+
+func (r *Redis) Save(chain string, cp services.Checkpoint) (services.Checkpoint, error) {
+	reply, err := r.cache(context.Background())("EVAL", saveScript, 1, RedisKey, chain, cp.Version, cp.BlockNum)
+	if err != nil {
+		return services.Checkpoint{}, err
+	}
+	version := cast.ToInt64(reply)
+	if version < 0 {
+		return services.Checkpoint{}, services.ErrCheckpointConflict
+	}
+	if version == 0 {
+		return services.Checkpoint{}, fmt.Errorf("unexpected redis reply %v", reply)
+	}
+	cp.Version = uint64(version)
+	return cp, nil
+}
+
+func toUint64(reply interface{}) uint64 {
+	if b, ok := reply.([]byte); ok {
+		return cast.ToUint64(string(b))
+	}
+	return cast.ToUint64(reply)
+}
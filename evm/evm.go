@@ -0,0 +1,445 @@
+// Package evm implements services.ChainIoV2 and services.ChainIo for Ethereum-compatible JSON-RPC endpoints.
+package evm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/evolutionlandorg/block-scan/services"
+	"github.com/evolutionlandorg/block-scan/util/log"
+	"github.com/evolutionlandorg/block-scan/util/rpc"
+)
+
+// Client reads blocks, logs and receipts through the standard eth_* methods.
+type Client struct {
+	rpc   *rpc.Client
+	chain string
+	// Timeout bounds each call made through the ChainIo returned by ChainIo(). Default 30s
+	Timeout time.Duration
+	// BatchSize is the most calls sent in one JSON-RPC batch. Default 100
+	BatchSize int
+}
+
+// batchAttempts is how many times a failed element of a batch is sent
+const batchAttempts = 3
+
+var (
+	_ services.ChainIoV2    = (*Client)(nil)
+	_ services.BatchChainIo = (*Client)(nil)
+	_ services.RangeChainIo = (*Client)(nil)
+)
+
+// tooManyResults are parts of the messages nodes reject eth_getLogs ranges with too many logs with.
+// Other errors, such as HTTP 429 Too Many Requests, are not a reason to shrink the range.
+var tooManyResults = []string{
+	"query returned more than",
+	"response size exceeded",
+	"log response size",
+}
+
+func isTooManyResults(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, v := range tooManyResults {
+		if strings.Contains(msg, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func New(client *rpc.Client, chain string) *Client {
+	return &Client{rpc: client, chain: chain, Timeout: 30 * time.Second, BatchSize: 100}
+}
+
+func Dial(ctx context.Context, rawurl, chain string) (*Client, error) {
+	client, err := rpc.DialContext(ctx, rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return New(client, chain), nil
+}
+
+func (c *Client) Close() {
+	c.rpc.Close()
+}
+
+type rpcLog struct {
+	Address         string         `json:"address"`
+	Topics          []string       `json:"topics"`
+	Data            string         `json:"data"`
+	TransactionHash string         `json:"transactionHash"`
+	BlockNumber     hexutil.Uint64 `json:"blockNumber"`
+	LogIndex        string         `json:"logIndex"`
+}
+
+type rpcReceipt struct {
+	BlockNumber      hexutil.Uint64 `json:"blockNumber"`
+	BlockHash        string         `json:"blockHash"`
+	Status           string         `json:"status"`
+	GasUsed          string         `json:"gasUsed"`
+	LogsBloom        string         `json:"logsBloom"`
+	TransactionIndex string         `json:"transactionIndex"`
+	Logs             []rpcLog       `json:"logs"`
+}
+
+type rpcTransaction struct {
+	Hash string `json:"hash"`
+	To   string `json:"to"`
+}
+
+type rpcBlock struct {
+	Hash       string         `json:"hash"`
+	ParentHash string         `json:"parentHash"`
+	Timestamp  hexutil.Uint64 `json:"timestamp"`
+	LogsBloom  string         `json:"logsBloom"`
+}
+
+type rpcFullBlock struct {
+	rpcBlock
+	Transactions []rpcTransaction `json:"transactions"`
+}
+
+func (c *Client) call(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	if err := c.rpc.CallContext(ctx, result, method, args...); err != nil {
+		return classify(fmt.Errorf("%s %s: %w", c.chain, method, err))
+	}
+	return nil
+}
+
+// classify marks the errors retrying cannot fix as permanent: malformed requests and client errors.
+func classify(err error) error {
+	var rpcErr rpc.Error
+	if errors.As(err, &rpcErr) {
+		switch rpcErr.ErrorCode() {
+		case -32700, -32600, -32601, -32602:
+			return services.Permanent(err)
+		}
+	}
+	var httpErr rpc.HTTPError
+	if errors.As(err, &httpErr) && httpErr.StatusCode >= 400 && httpErr.StatusCode < 500 &&
+		httpErr.StatusCode != 408 && httpErr.StatusCode != 429 {
+		return services.Permanent(err)
+	}
+	return err
+}
+
+func (c *Client) receipt(ctx context.Context, tx string) (*rpcReceipt, error) {
+	var receipt *rpcReceipt
+	if err := c.call(ctx, &receipt, "eth_getTransactionReceipt", tx); err != nil {
+		return nil, err
+	}
+	if receipt == nil {
+		return nil, fmt.Errorf("%s receipt of %s: %w", c.chain, tx, services.ErrNotAvailable)
+	}
+	return receipt, nil
+}
+
+func (c *Client) ReceiptLog(ctx context.Context, tx string) (*services.Receipts, error) {
+	receipt, err := c.receipt(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	return c.receipts(receipt), nil
+}
+
+func (c *Client) receipts(receipt *rpcReceipt) *services.Receipts {
+	logs := make([]services.Log, 0, len(receipt.Logs))
+	for _, l := range receipt.Logs {
+		logs = append(logs, services.Log{Topics: l.Topics, Data: l.Data, Address: l.Address, LogIndex: l.LogIndex})
+	}
+	return &services.Receipts{
+		BlockNumber:      fmt.Sprint(uint64(receipt.BlockNumber)),
+		Logs:             logs,
+		Status:           receipt.Status,
+		ChainSource:      c.chain,
+		GasUsed:          receipt.GasUsed,
+		LogsBloom:        receipt.LogsBloom,
+		TransactionIndex: receipt.TransactionIndex,
+		BlockHash:        receipt.BlockHash,
+	}
+}
+
+func (c *Client) BlockNumber(ctx context.Context) (uint64, error) {
+	var blockNum hexutil.Uint64
+	if err := c.call(ctx, &blockNum, "eth_blockNumber"); err != nil {
+		return 0, err
+	}
+	return uint64(blockNum), nil
+}
+
+// FilterTrans returns the transactions of blockNum that emitted a log from one of the filter addresses,
+// in the order of their first log. The block timestamp is only fetched when there are transactions.
+func (c *Client) FilterTrans(ctx context.Context, blockNum uint64, filter []string) (*services.BlockTrans, error) {
+	number := hexutil.EncodeUint64(blockNum)
+	var logs []rpcLog
+	if err := c.call(ctx, &logs, "eth_getLogs", map[string]interface{}{
+		"fromBlock": number,
+		"toBlock":   number,
+		"address":   filter,
+	}); err != nil {
+		return nil, err
+	}
+	trans := new(services.BlockTrans)
+	if len(logs) == 0 {
+		return trans, nil
+	}
+
+	var block *rpcFullBlock
+	if err := c.call(ctx, &block, "eth_getBlockByNumber", number, true); err != nil {
+		return nil, err
+	}
+	if block == nil {
+		return nil, fmt.Errorf("%s block %d: %w", c.chain, blockNum, services.ErrNotAvailable)
+	}
+	to := make(map[string]string, len(block.Transactions))
+	for _, tx := range block.Transactions {
+		to[strings.ToLower(tx.Hash)] = tx.To
+	}
+	seen := make(map[string]struct{})
+	for _, l := range logs {
+		if _, ok := seen[l.TransactionHash]; ok {
+			continue
+		}
+		seen[l.TransactionHash] = struct{}{}
+		trans.Txn = append(trans.Txn, l.TransactionHash)
+		trans.Contracts = append(trans.Contracts, strings.ToLower(l.Address))
+		trans.TransactionTo = append(trans.TransactionTo, to[strings.ToLower(l.TransactionHash)])
+	}
+	trans.Timestamp = uint64(block.Timestamp)
+	return trans, nil
+}
+
+// FilterRange is FilterTrans over the blocks in [from, to] with a single eth_getLogs call. The block
+// timestamps are fetched in one batch and TransactionTo is left empty.
+func (c *Client) FilterRange(ctx context.Context, from, to uint64, filter []string) (map[uint64]*services.BlockTrans, error) {
+	var logs []rpcLog
+	if err := c.rpc.CallContext(ctx, &logs, "eth_getLogs", map[string]interface{}{
+		"fromBlock": hexutil.EncodeUint64(from),
+		"toBlock":   hexutil.EncodeUint64(to),
+		"address":   filter,
+	}); err != nil {
+		if isTooManyResults(err) {
+			return nil, fmt.Errorf("%s eth_getLogs %d-%d: %v: %w", c.chain, from, to, err, services.ErrTooManyResults)
+		}
+		return nil, classify(fmt.Errorf("%s eth_getLogs: %w", c.chain, err))
+	}
+
+	var (
+		blocks = make(map[uint64]*services.BlockTrans)
+		nums   []uint64
+		seen   = make(map[string]struct{})
+	)
+	for _, l := range logs {
+		if _, ok := seen[l.TransactionHash]; ok {
+			continue
+		}
+		seen[l.TransactionHash] = struct{}{}
+		num := uint64(l.BlockNumber)
+		trans, ok := blocks[num]
+		if !ok {
+			trans = new(services.BlockTrans)
+			blocks[num] = trans
+			nums = append(nums, num)
+		}
+		trans.Txn = append(trans.Txn, l.TransactionHash)
+		trans.Contracts = append(trans.Contracts, strings.ToLower(l.Address))
+		trans.TransactionTo = append(trans.TransactionTo, "")
+	}
+	if len(nums) == 0 {
+		return blocks, nil
+	}
+	headers, err := c.BlockHeaders(ctx, nums)
+	for i, num := range nums {
+		if err := services.BatchErr(err, i); err != nil {
+			return nil, err
+		}
+		if headers[i] == nil {
+			return nil, fmt.Errorf("%s block %d: %w", c.chain, num, services.ErrNotAvailable)
+		}
+		blocks[num].Timestamp = headers[i].BlockTimeStamp
+	}
+	return blocks, nil
+}
+
+func (c *Client) BlockHeader(ctx context.Context, blockNum uint64) (*services.BlockHeader, error) {
+	var block *rpcBlock
+	if err := c.call(ctx, &block, "eth_getBlockByNumber", hexutil.EncodeUint64(blockNum), false); err != nil {
+		return nil, err
+	}
+	if block == nil {
+		return nil, fmt.Errorf("%s block %d: %w", c.chain, blockNum, services.ErrNotAvailable)
+	}
+	return block.header(), nil
+}
+
+func (b *rpcBlock) header() *services.BlockHeader {
+	return &services.BlockHeader{
+		BlockTimeStamp: uint64(b.Timestamp),
+		Hash:           b.Hash,
+		ParentHash:     b.ParentHash,
+		LogsBloom:      b.LogsBloom,
+	}
+}
+
+// batch sends elems in batches of at most BatchSize. Elements that fail with a retryable error
+// are sent again, up to batchAttempts times. The returned errors line up with elems.
+func (c *Client) batch(ctx context.Context, elems []rpc.BatchElem) []error {
+	size := c.BatchSize
+	if size <= 0 {
+		size = 100
+	}
+	errs := make([]error, len(elems))
+	pending := make([]int, len(elems))
+	for i := range pending {
+		pending[i] = i
+	}
+	for attempt := 1; ; attempt++ {
+		var failed []int
+		for start := 0; start < len(pending); start += size {
+			end := start + size
+			if end > len(pending) {
+				end = len(pending)
+			}
+			b := make([]rpc.BatchElem, 0, end-start)
+			for _, i := range pending[start:end] {
+				b = append(b, rpc.BatchElem{Method: elems[i].Method, Args: elems[i].Args, Result: elems[i].Result})
+			}
+			batchErr := c.rpc.BatchCallContext(ctx, b)
+			for j, i := range pending[start:end] {
+				errs[i] = nil
+				// an error of the whole call applies to every element
+				if err := batchErr; err != nil || b[j].Error != nil {
+					if err == nil {
+						err = b[j].Error
+					}
+					errs[i] = classify(fmt.Errorf("%s %s: %w", c.chain, b[j].Method, err))
+				}
+				if services.IsRetryable(errs[i]) {
+					failed = append(failed, i)
+				}
+			}
+		}
+		if len(failed) == 0 || attempt >= batchAttempts {
+			return errs
+		}
+		select {
+		case <-ctx.Done():
+			return errs
+		case <-time.After(time.Duration(attempt) * 100 * time.Millisecond):
+		}
+		pending = failed
+	}
+}
+
+// ReceiptLogs fetches the receipts of txs with eth_getTransactionReceipt batch calls.
+func (c *Client) ReceiptLogs(ctx context.Context, txs []string) ([]*services.Receipts, error) {
+	raw := make([]*rpcReceipt, len(txs))
+	elems := make([]rpc.BatchElem, len(txs))
+	for i, tx := range txs {
+		elems[i] = rpc.BatchElem{Method: "eth_getTransactionReceipt", Args: []interface{}{tx}, Result: &raw[i]}
+	}
+	errs := c.batch(ctx, elems)
+	receipts := make([]*services.Receipts, len(txs))
+	for i, receipt := range raw {
+		if errs[i] == nil && receipt != nil {
+			receipts[i] = c.receipts(receipt)
+		}
+	}
+	return receipts, services.NewBatchError(errs)
+}
+
+// BlockHeaders fetches the headers of nums with eth_getBlockByNumber batch calls.
+func (c *Client) BlockHeaders(ctx context.Context, nums []uint64) ([]*services.BlockHeader, error) {
+	raw := make([]*rpcBlock, len(nums))
+	elems := make([]rpc.BatchElem, len(nums))
+	for i, num := range nums {
+		elems[i] = rpc.BatchElem{Method: "eth_getBlockByNumber", Args: []interface{}{hexutil.EncodeUint64(num), false}, Result: &raw[i]}
+	}
+	errs := c.batch(ctx, elems)
+	headers := make([]*services.BlockHeader, len(nums))
+	for i, block := range raw {
+		if errs[i] == nil && block != nil {
+			headers[i] = block.header()
+		}
+	}
+	return headers, services.NewBatchError(errs)
+}
+
+// GetTransactionStatus reads the status of the receipt. Receipts from before Byzantium have no status
+// and are reported as successful.
+func (c *Client) GetTransactionStatus(ctx context.Context, tx string) (services.TxStatus, error) {
+	receipt, err := c.receipt(ctx, tx)
+	if err != nil {
+		return "", err
+	}
+	if receipt.Status == "0x0" {
+		return services.TxStatusFail, nil
+	}
+	return services.TxStatusSuccess, nil
+}
+
+// ChainIo returns the client as a services.ChainIo. Each call is bounded by Timeout,
+// and errors the old interface cannot return are logged. A failed FilterTrans looks like
+// a block without transactions there, so prefer setting the Client as ChainIoV2.
+func (c *Client) ChainIo() services.ChainIo {
+	return &chainIo{c: c}
+}
+
+type chainIo struct {
+	c *Client
+}
+
+func (v *chainIo) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), v.c.Timeout)
+}
+
+func (v *chainIo) ReceiptLog(tx string) (*services.Receipts, error) {
+	ctx, cancel := v.context()
+	defer cancel()
+	return v.c.ReceiptLog(ctx, tx)
+}
+
+func (v *chainIo) BlockNumber() uint64 {
+	ctx, cancel := v.context()
+	defer cancel()
+	blockNum, err := v.c.BlockNumber(ctx)
+	if err != nil {
+		log.Warn("%s get block number error: %v", v.c.chain, err)
+	}
+	return blockNum
+}
+
+func (v *chainIo) FilterTrans(blockNum uint64, filter []string) (txn []string, contracts []string, timestamp uint64, transactionTo []string) {
+	ctx, cancel := v.context()
+	defer cancel()
+	trans, err := v.c.FilterTrans(ctx, blockNum, filter)
+	if err != nil {
+		log.Warn("%s filter block %d error: %v", v.c.chain, blockNum, err)
+		return nil, nil, 0, nil
+	}
+	return trans.Txn, trans.Contracts, trans.Timestamp, trans.TransactionTo
+}
+
+func (v *chainIo) BlockHeader(blockNum uint64) *services.BlockHeader {
+	ctx, cancel := v.context()
+	defer cancel()
+	header, err := v.c.BlockHeader(ctx, blockNum)
+	if err != nil {
+		log.Warn("%s get block header %d error: %v", v.c.chain, blockNum, err)
+	}
+	return header
+}
+
+func (v *chainIo) GetTransactionStatus(tx string) string {
+	ctx, cancel := v.context()
+	defer cancel()
+	status, err := v.c.GetTransactionStatus(ctx, tx)
+	if err != nil {
+		log.Warn("%s get transaction %s status error: %v", v.c.chain, tx, err)
+	}
+	return string(status)
+}
@@ -0,0 +1,229 @@
+package evm
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/evolutionlandorg/block-scan/services"
+	"github.com/evolutionlandorg/block-scan/util/rpc"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeEth serves the eth_* methods the client uses from a fixed chain of three blocks.
+type fakeEth struct {
+	mu       sync.Mutex
+	receipts map[string]int
+}
+
+func (f *fakeEth) BlockNumber() hexutil.Uint64 {
+	return 3
+}
+
+func (f *fakeEth) GetBlockByNumber(number hexutil.Uint64, full bool) (map[string]interface{}, error) {
+	if number > 3 {
+		return nil, nil
+	}
+	block := map[string]interface{}{
+		"hash":       "0xb" + number.String()[2:],
+		"parentHash": "0xb" + (number - 1).String()[2:],
+		"timestamp":  hexutil.Uint64(1000 + number),
+		"logsBloom":  "0x00",
+	}
+	if full {
+		block["transactions"] = []map[string]interface{}{
+			{"hash": "0xa1", "to": "0xrouter"},
+			{"hash": "0xa2", "to": "0x222"},
+		}
+	}
+	return block, nil
+}
+
+func (f *fakeEth) GetLogs(filter struct {
+	FromBlock hexutil.Uint64 `json:"fromBlock"`
+	ToBlock   hexutil.Uint64 `json:"toBlock"`
+	Address   []string       `json:"address"`
+}) ([]map[string]interface{}, error) {
+	if filter.ToBlock-filter.FromBlock > 10 {
+		return nil, errors.New("query returned more than 10000 results")
+	}
+	if filter.FromBlock > 2 || filter.ToBlock < 2 {
+		return []map[string]interface{}{}, nil
+	}
+	return []map[string]interface{}{
+		{"address": "0x222", "topics": []string{"0x01"}, "data": "0x", "transactionHash": "0xa1", "blockNumber": "0x2"},
+		{"address": "0x222", "topics": []string{"0x02"}, "data": "0x", "transactionHash": "0xa1", "blockNumber": "0x2"},
+		{"address": "0x222", "topics": []string{"0x01"}, "data": "0x", "transactionHash": "0xa2", "blockNumber": "0x2"},
+	}, nil
+}
+
+func (f *fakeEth) GetTransactionReceipt(tx string) (map[string]interface{}, error) {
+	f.mu.Lock()
+	if f.receipts == nil {
+		f.receipts = make(map[string]int)
+	}
+	f.receipts[tx]++
+	calls := f.receipts[tx]
+	f.mu.Unlock()
+	switch tx {
+	case "0xflaky":
+		if calls == 1 {
+			return nil, errors.New("header not found")
+		}
+		return map[string]interface{}{"blockNumber": "0x3", "status": "0x1", "logs": []interface{}{}}, nil
+	case "0xa1":
+		return map[string]interface{}{
+			"blockNumber": "0x2",
+			"blockHash":   "0xb2",
+			"status":      "0x1",
+			"gasUsed":     "0x5208",
+			"logs":        []map[string]interface{}{{"address": "0x222", "topics": []string{"0x01"}, "data": "0x", "logIndex": "0x7"}},
+		}, nil
+	case "0xa2":
+		return map[string]interface{}{"blockNumber": "0x2", "status": "0x0", "logs": []interface{}{}}, nil
+	case "0xbad":
+		return nil, errors.New("internal error")
+	}
+	return nil, nil
+}
+
+func newClient(t *testing.T) (*Client, *fakeEth) {
+	eth := new(fakeEth)
+	server := rpc.NewServer()
+	assert.NoError(t, server.RegisterName("eth", eth))
+	client := New(rpc.DialInProc(server), "Crab")
+	t.Cleanup(func() {
+		client.Close()
+		server.Stop()
+	})
+	return client, eth
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	c, _ := newClient(t)
+
+	blockNum, err := c.BlockNumber(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), blockNum)
+
+	header, err := c.BlockHeader(ctx, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, &services.BlockHeader{BlockTimeStamp: 1002, Hash: "0xb2", ParentHash: "0xb1", LogsBloom: "0x00"}, header)
+	_, err = c.BlockHeader(ctx, 4)
+	assert.ErrorIs(t, err, services.ErrNotAvailable)
+
+	trans, err := c.FilterTrans(ctx, 2, []string{"0x222"})
+	assert.NoError(t, err)
+	assert.Equal(t, &services.BlockTrans{
+		Txn:           []string{"0xa1", "0xa2"},
+		Contracts:     []string{"0x222", "0x222"},
+		Timestamp:     1002,
+		TransactionTo: []string{"0xrouter", "0x222"},
+	}, trans)
+	trans, err = c.FilterTrans(ctx, 1, []string{"0x222"})
+	assert.NoError(t, err)
+	assert.Empty(t, trans.Txn)
+
+	receipt, err := c.ReceiptLog(ctx, "0xa1")
+	assert.NoError(t, err)
+	assert.Equal(t, &services.Receipts{
+		BlockNumber: "2",
+		Logs:        []services.Log{{Topics: []string{"0x01"}, Data: "0x", Address: "0x222", LogIndex: "0x7"}},
+		Status:      "0x1",
+		ChainSource: "Crab",
+		GasUsed:     "0x5208",
+		BlockHash:   "0xb2",
+	}, receipt)
+
+	status, err := c.GetTransactionStatus(ctx, "0xa2")
+	assert.NoError(t, err)
+	assert.Equal(t, services.TxStatusFail, status)
+
+	_, err = c.ReceiptLog(ctx, "0xa3")
+	assert.ErrorIs(t, err, services.ErrNotAvailable)
+	_, err = c.ReceiptLog(ctx, "0xbad")
+	assert.True(t, services.IsRetryable(err))
+
+	// unknown methods can never succeed
+	err = c.call(ctx, nil, "eth_unknown")
+	assert.True(t, services.IsPermanent(err))
+}
+
+func TestClientChainIo(t *testing.T) {
+	c, _ := newClient(t)
+	io := c.ChainIo()
+	assert.Equal(t, uint64(3), io.BlockNumber())
+	txn, contracts, timestamp, _ := io.FilterTrans(2, []string{"0x222"})
+	assert.Equal(t, []string{"0xa1", "0xa2"}, txn)
+	assert.Equal(t, []string{"0x222", "0x222"}, contracts)
+	assert.Equal(t, uint64(1002), timestamp)
+	assert.Nil(t, io.BlockHeader(4))
+	assert.Equal(t, "Success", io.GetTransactionStatus("0xa1"))
+}
+
+func TestClientBatch(t *testing.T) {
+	ctx := context.Background()
+	c, eth := newClient(t)
+	c.BatchSize = 2
+
+	receipts, err := c.ReceiptLogs(ctx, []string{"0xa1", "0xflaky", "0xa2", "0xa3", "0xbad"})
+	assert.Len(t, receipts, 5)
+	assert.Equal(t, "2", receipts[0].BlockNumber)
+	assert.Equal(t, "3", receipts[1].BlockNumber)
+	assert.Equal(t, "0x0", receipts[2].Status)
+	assert.Nil(t, receipts[3])
+	assert.Nil(t, receipts[4])
+
+	var batchErr *services.BatchError
+	assert.ErrorAs(t, err, &batchErr)
+	assert.Len(t, batchErr.Errors, 1)
+	assert.ErrorContains(t, services.BatchErr(err, 4), "internal error")
+	assert.NoError(t, services.BatchErr(err, 1))
+
+	// only the failed elements are sent again
+	eth.mu.Lock()
+	assert.Equal(t, map[string]int{"0xa1": 1, "0xflaky": 2, "0xa2": 1, "0xa3": 1, "0xbad": batchAttempts}, eth.receipts)
+	eth.mu.Unlock()
+
+	headers, err := c.BlockHeaders(ctx, []uint64{1, 2, 4})
+	assert.NoError(t, err)
+	assert.Equal(t, "0xb1", headers[0].Hash)
+	assert.Equal(t, uint64(1002), headers[1].BlockTimeStamp)
+	assert.Nil(t, headers[2])
+}
+
+func TestClientFilterRange(t *testing.T) {
+	ctx := context.Background()
+	c, _ := newClient(t)
+
+	blocks, err := c.FilterRange(ctx, 1, 3, []string{"0x222"})
+	assert.NoError(t, err)
+	assert.Len(t, blocks, 1)
+	assert.Equal(t, []string{"0xa1", "0xa2"}, blocks[2].Txn)
+	assert.Equal(t, []string{"0x222", "0x222"}, blocks[2].Contracts)
+	assert.Equal(t, uint64(1002), blocks[2].Timestamp)
+
+	_, err = c.FilterRange(ctx, 1, 100, []string{"0x222"})
+	assert.ErrorIs(t, err, services.ErrTooManyResults)
+	assert.False(t, services.IsPermanent(err))
+}
+
+func TestIsTooManyResults(t *testing.T) {
+	for _, tt := range []struct {
+		err  string
+		want bool
+	}{
+		{"query returned more than 10000 results", true},
+		{"Query returned more than 10000 results. Try with this block range [0x1, 0x20].", true},
+		{"response size exceeded", true},
+		{"Log response size exceeded. You can make eth_getLogs requests with up to a 2K block range", true},
+		{"429 Too Many Requests: rate limit exceeded", false},
+		{"too many connections", false},
+		{"connection refused", false},
+	} {
+		assert.Equal(t, tt.want, isTooManyResults(errors.New(tt.err)), tt.err)
+	}
+}
@@ -0,0 +1,489 @@
+// Package failover spreads the reads of a chain over several ChainIoV2 endpoints.
+package failover
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/evolutionlandorg/block-scan/services"
+	"github.com/evolutionlandorg/block-scan/util/log"
+)
+
+type Endpoint struct {
+	Name    string
+	ChainIo services.ChainIoV2
+}
+
+type Options struct {
+	// Quorum is how many endpoints must return the same block header, transactions or receipt
+	// before it is accepted. 0 or 1 reads from a single endpoint
+	Quorum int
+	// MaxLag is how many blocks an endpoint may be behind the others before it is unhealthy. Default 5
+	MaxLag uint64
+	// MaxFailures is how many consecutive errors make an endpoint unhealthy. Default 3
+	MaxFailures int
+	// Cooldown is how long an unhealthy endpoint is only used when no other is left. Default 30s
+	Cooldown time.Duration
+}
+
+type EndpointStatus struct {
+	Name    string
+	Healthy bool
+	// Reason is why the endpoint was last marked unhealthy
+	Reason string
+	// Latency is the moving average of the call latency
+	Latency time.Duration
+	// ErrorRate is the moving average of failed calls, between 0 and 1
+	ErrorRate float64
+	// Head is the last block number the endpoint reported
+	Head uint64
+}
+
+type endpoint struct {
+	Endpoint
+	latency        time.Duration
+	errorRate      float64
+	failures       int
+	head           uint64
+	unhealthyUntil time.Time
+	reason         string
+}
+
+// Failover is a services.ChainIoV2 over several endpoints of one chain. Reads go to the healthy
+// endpoint with the best score, which grows with latency and error rate, and move on to the next
+// one when it fails. Endpoints that keep failing, fall behind the others or disagree with the quorum
+// are marked unhealthy for Options.Cooldown.
+type Failover struct {
+	chain     string
+	opt       Options
+	mu        sync.Mutex
+	endpoints []*endpoint
+}
+
+var (
+	_ services.ChainIoV2    = (*Failover)(nil)
+	_ services.BatchChainIo = (*Failover)(nil)
+	_ services.RangeChainIo = (*Failover)(nil)
+)
+
+func New(chain string, opt Options, endpoints ...Endpoint) (*Failover, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("at least one endpoint is required")
+	}
+	if opt.Quorum > len(endpoints) {
+		return nil, fmt.Errorf("quorum %d is larger than the %d endpoints", opt.Quorum, len(endpoints))
+	}
+	if opt.MaxLag == 0 {
+		opt.MaxLag = 5
+	}
+	if opt.MaxFailures <= 0 {
+		opt.MaxFailures = 3
+	}
+	if opt.Cooldown <= 0 {
+		opt.Cooldown = 30 * time.Second
+	}
+	f := &Failover{chain: chain, opt: opt}
+	for _, e := range endpoints {
+		if e.ChainIo == nil {
+			return nil, fmt.Errorf("endpoint %s has no ChainIo", e.Name)
+		}
+		f.endpoints = append(f.endpoints, &endpoint{Endpoint: e})
+	}
+	return f, nil
+}
+
+func (f *Failover) Status() []EndpointStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	var statuses []EndpointStatus
+	for _, e := range f.endpoints {
+		statuses = append(statuses, EndpointStatus{
+			Name:      e.Name,
+			Healthy:   !now.Before(e.unhealthyUntil),
+			Reason:    e.reason,
+			Latency:   e.latency,
+			ErrorRate: e.errorRate,
+			Head:      e.head,
+		})
+	}
+	return statuses
+}
+
+// ordered returns the healthy endpoints by score, followed by the unhealthy ones.
+func (f *Failover) ordered() []*endpoint {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	var healthy, unhealthy []*endpoint
+	for _, e := range f.endpoints {
+		if now.Before(e.unhealthyUntil) {
+			unhealthy = append(unhealthy, e)
+		} else {
+			healthy = append(healthy, e)
+		}
+	}
+	score := func(e *endpoint) float64 {
+		return float64(e.latency) * (1 + 10*e.errorRate)
+	}
+	sort.SliceStable(healthy, func(i, j int) bool { return score(healthy[i]) < score(healthy[j]) })
+	sort.SliceStable(unhealthy, func(i, j int) bool { return unhealthy[i].unhealthyUntil.Before(unhealthy[j].unhealthyUntil) })
+	return append(healthy, unhealthy...)
+}
+
+// record updates the score of e after a call that started at start. A range refused with
+// services.ErrTooManyResults is an answer, not a failure of the endpoint.
+func (f *Failover) record(ctx context.Context, e *endpoint, start time.Time, err error) {
+	if ctx.Err() != nil || errors.Is(err, errNoBatch) || errors.Is(err, services.ErrTooManyResults) {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	const alpha = 0.2
+	latency := time.Since(start)
+	if e.latency == 0 {
+		e.latency = latency
+	} else {
+		e.latency = time.Duration(alpha*float64(latency) + (1-alpha)*float64(e.latency))
+	}
+	// a node without the requested data yet is slow, not broken
+	if err == nil || errors.Is(err, services.ErrNotAvailable) {
+		e.errorRate = (1 - alpha) * e.errorRate
+		e.failures = 0
+		return
+	}
+	e.errorRate = alpha + (1-alpha)*e.errorRate
+	if e.failures++; e.failures >= f.opt.MaxFailures {
+		f.markUnhealthy(e, fmt.Sprintf("%d consecutive errors, last: %v", e.failures, err))
+	}
+}
+
+// markUnhealthy must be called with f.mu held.
+func (f *Failover) markUnhealthy(e *endpoint, reason string) {
+	if time.Now().Before(e.unhealthyUntil) {
+		return
+	}
+	log.Warn("%s endpoint %s is unhealthy: %s", f.chain, e.Name, reason)
+	e.unhealthyUntil = time.Now().Add(f.opt.Cooldown)
+	e.reason = reason
+}
+
+// read calls call on the endpoints in order until one succeeds, and returns the last error otherwise.
+// services.ErrTooManyResults is returned at once, the other endpoints would refuse the range as well.
+func (f *Failover) read(ctx context.Context, call func(c services.ChainIoV2) error) error {
+	var err error
+	for _, e := range f.ordered() {
+		start := time.Now()
+		err = call(e.ChainIo)
+		f.record(ctx, e, start, err)
+		if err == nil || ctx.Err() != nil || errors.Is(err, services.ErrTooManyResults) {
+			return err
+		}
+		log.Debug("%s endpoint %s error: %v", f.chain, e.Name, err)
+	}
+	return err
+}
+
+type answer struct {
+	e     *endpoint
+	value interface{}
+	err   error
+}
+
+// all calls call on every healthy endpoint at once, or on every endpoint if too few are healthy for the quorum.
+func (f *Failover) all(ctx context.Context, call func(c services.ChainIoV2) (interface{}, error)) []answer {
+	endpoints := f.ordered()
+	now := time.Now()
+	healthy := 0
+	f.mu.Lock()
+	for _, e := range endpoints {
+		if !now.Before(e.unhealthyUntil) {
+			healthy++
+		}
+	}
+	f.mu.Unlock()
+	if healthy >= f.opt.Quorum && healthy > 0 {
+		endpoints = endpoints[:healthy]
+	}
+	answers := make([]answer, len(endpoints))
+	var wg sync.WaitGroup
+	for i, e := range endpoints {
+		wg.Add(1)
+		go func(i int, e *endpoint) {
+			defer wg.Done()
+			start := time.Now()
+			value, err := call(e.ChainIo)
+			f.record(ctx, e, start, err)
+			answers[i] = answer{e: e, value: value, err: err}
+		}(i, e)
+	}
+	wg.Wait()
+	return answers
+}
+
+// quorum returns the value at least Options.Quorum endpoints agree on, compared by key.
+// Endpoints that answered something else are marked unhealthy.
+func (f *Failover) quorum(ctx context.Context, what string, call func(c services.ChainIoV2) (interface{}, error), key func(interface{}) string) (interface{}, error) {
+	var (
+		answers = f.all(ctx, call)
+		groups  = make(map[string][]answer)
+		best    string
+		lastErr error
+	)
+	for _, a := range answers {
+		if a.err != nil {
+			lastErr = a.err
+			continue
+		}
+		k := key(a.value)
+		groups[k] = append(groups[k], a)
+		if len(groups[k]) > len(groups[best]) {
+			best = k
+		}
+	}
+	if len(groups[best]) < f.opt.Quorum {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if len(groups) == 0 && lastErr != nil {
+			return nil, lastErr
+		}
+		return nil, fmt.Errorf("%s %s: %d of %d endpoints agree: %w", f.chain, what, len(groups[best]), f.opt.Quorum, services.ErrNotAvailable)
+	}
+	f.mu.Lock()
+	for k, group := range groups {
+		if k == best {
+			continue
+		}
+		for _, a := range group {
+			f.markUnhealthy(a.e, fmt.Sprintf("%s disagrees with %d other endpoints", what, len(groups[best])))
+		}
+	}
+	f.mu.Unlock()
+	return groups[best][0].value, nil
+}
+
+func digest(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func (f *Failover) quorumMode() bool {
+	return f.opt.Quorum > 1
+}
+
+// BlockNumber asks every healthy endpoint for its head and marks those more than MaxLag blocks behind
+// as unhealthy. It returns the highest head, or in quorum mode the highest head that Quorum endpoints have reached.
+func (f *Failover) BlockNumber(ctx context.Context) (uint64, error) {
+	var (
+		heads   []uint64
+		lastErr error
+	)
+	answers := f.all(ctx, func(c services.ChainIoV2) (interface{}, error) {
+		return c.BlockNumber(ctx)
+	})
+	f.mu.Lock()
+	for _, a := range answers {
+		if a.err != nil {
+			lastErr = a.err
+			continue
+		}
+		a.e.head = a.value.(uint64)
+		heads = append(heads, a.e.head)
+	}
+	sort.Slice(heads, func(i, j int) bool { return heads[i] > heads[j] })
+	for _, a := range answers {
+		if a.err == nil && len(heads) > 0 && a.e.head+f.opt.MaxLag < heads[0] {
+			f.markUnhealthy(a.e, fmt.Sprintf("%d blocks behind", heads[0]-a.e.head))
+		}
+	}
+	f.mu.Unlock()
+	if len(heads) == 0 {
+		return 0, lastErr
+	}
+	if f.quorumMode() {
+		if len(heads) < f.opt.Quorum {
+			return 0, fmt.Errorf("%s block number: %d of %d endpoints answered: %w", f.chain, len(heads), f.opt.Quorum, services.ErrNotAvailable)
+		}
+		return heads[f.opt.Quorum-1], nil
+	}
+	return heads[0], nil
+}
+
+func (f *Failover) BlockHeader(ctx context.Context, blockNum uint64) (*services.BlockHeader, error) {
+	call := func(c services.ChainIoV2) (interface{}, error) {
+		return c.BlockHeader(ctx, blockNum)
+	}
+	if f.quorumMode() {
+		header, err := f.quorum(ctx, fmt.Sprintf("block %d hash", blockNum), call, func(v interface{}) string {
+			return v.(*services.BlockHeader).Hash
+		})
+		if err != nil {
+			return nil, err
+		}
+		return header.(*services.BlockHeader), nil
+	}
+	var header *services.BlockHeader
+	err := f.read(ctx, func(c services.ChainIoV2) (err error) {
+		header, err = c.BlockHeader(ctx, blockNum)
+		return err
+	})
+	return header, err
+}
+
+func (f *Failover) FilterTrans(ctx context.Context, blockNum uint64, filter []string) (*services.BlockTrans, error) {
+	call := func(c services.ChainIoV2) (interface{}, error) {
+		return c.FilterTrans(ctx, blockNum, filter)
+	}
+	if f.quorumMode() {
+		trans, err := f.quorum(ctx, fmt.Sprintf("block %d transactions", blockNum), call, digest)
+		if err != nil {
+			return nil, err
+		}
+		return trans.(*services.BlockTrans), nil
+	}
+	var trans *services.BlockTrans
+	err := f.read(ctx, func(c services.ChainIoV2) (err error) {
+		trans, err = c.FilterTrans(ctx, blockNum, filter)
+		return err
+	})
+	return trans, err
+}
+
+func (f *Failover) ReceiptLog(ctx context.Context, tx string) (*services.Receipts, error) {
+	call := func(c services.ChainIoV2) (interface{}, error) {
+		return c.ReceiptLog(ctx, tx)
+	}
+	if f.quorumMode() {
+		receipt, err := f.quorum(ctx, "receipt of "+tx, call, digest)
+		if err != nil {
+			return nil, err
+		}
+		return receipt.(*services.Receipts), nil
+	}
+	var receipt *services.Receipts
+	err := f.read(ctx, func(c services.ChainIoV2) (err error) {
+		receipt, err = c.ReceiptLog(ctx, tx)
+		return err
+	})
+	return receipt, err
+}
+
+func (f *Failover) GetTransactionStatus(ctx context.Context, tx string) (services.TxStatus, error) {
+	call := func(c services.ChainIoV2) (interface{}, error) {
+		return c.GetTransactionStatus(ctx, tx)
+	}
+	if f.quorumMode() {
+		status, err := f.quorum(ctx, "status of "+tx, call, digest)
+		if err != nil {
+			return "", err
+		}
+		return status.(services.TxStatus), nil
+	}
+	var status services.TxStatus
+	err := f.read(ctx, func(c services.ChainIoV2) (err error) {
+		status, err = c.GetTransactionStatus(ctx, tx)
+		return err
+	})
+	return status, err
+}
+
+// ReceiptLogs uses the batch calls of the best endpoint if it has them. In quorum mode
+// every receipt is compared across endpoints with ReceiptLog.
+func (f *Failover) ReceiptLogs(ctx context.Context, txs []string) ([]*services.Receipts, error) {
+	receipts := make([]*services.Receipts, len(txs))
+	if !f.quorumMode() {
+		var batchErr error
+		err := f.read(ctx, func(c services.ChainIoV2) error {
+			batch, ok := c.(services.BatchChainIo)
+			if !ok {
+				return errNoBatch
+			}
+			receipts, batchErr = batch.ReceiptLogs(ctx, txs)
+			return wholeBatchErr(batchErr, len(txs))
+		})
+		if err == nil {
+			return receipts, batchErr
+		}
+		if !errors.Is(err, errNoBatch) {
+			return nil, err
+		}
+		receipts = make([]*services.Receipts, len(txs))
+	}
+	errs := make([]error, len(txs))
+	for i, tx := range txs {
+		if receipts[i], errs[i] = f.ReceiptLog(ctx, tx); errors.Is(errs[i], services.ErrNotAvailable) {
+			receipts[i], errs[i] = nil, nil
+		}
+	}
+	return receipts, services.NewBatchError(errs)
+}
+
+// BlockHeaders is ReceiptLogs for block headers.
+func (f *Failover) BlockHeaders(ctx context.Context, nums []uint64) ([]*services.BlockHeader, error) {
+	headers := make([]*services.BlockHeader, len(nums))
+	if !f.quorumMode() {
+		var batchErr error
+		err := f.read(ctx, func(c services.ChainIoV2) error {
+			batch, ok := c.(services.BatchChainIo)
+			if !ok {
+				return errNoBatch
+			}
+			headers, batchErr = batch.BlockHeaders(ctx, nums)
+			return wholeBatchErr(batchErr, len(nums))
+		})
+		if err == nil {
+			return headers, batchErr
+		}
+		if !errors.Is(err, errNoBatch) {
+			return nil, err
+		}
+		headers = make([]*services.BlockHeader, len(nums))
+	}
+	errs := make([]error, len(nums))
+	for i, num := range nums {
+		if headers[i], errs[i] = f.BlockHeader(ctx, num); errors.Is(errs[i], services.ErrNotAvailable) {
+			headers[i], errs[i] = nil, nil
+		}
+	}
+	return headers, services.NewBatchError(errs)
+}
+
+// errNoBatch is returned by endpoints without batch calls or range queries; it is not counted against them.
+var errNoBatch = services.Permanent(errors.New("endpoint has no batch calls"))
+
+// wholeBatchErr keeps err only if every element failed, so a partly failed batch does not move on to
+// the next endpoint.
+func wholeBatchErr(err error, n int) error {
+	var batchErr *services.BatchError
+	if errors.As(err, &batchErr) && len(batchErr.Errors) < n {
+		return nil
+	}
+	return err
+}
+
+// FilterRange is sent to the endpoints with range queries. In quorum mode it returns
+// services.ErrNotSupported, so the blocks are checked one by one.
+func (f *Failover) FilterRange(ctx context.Context, from, to uint64, filter []string) (map[uint64]*services.BlockTrans, error) {
+	if f.quorumMode() {
+		return nil, services.ErrNotSupported
+	}
+	var blocks map[uint64]*services.BlockTrans
+	err := f.read(ctx, func(c services.ChainIoV2) (err error) {
+		ranger, ok := c.(services.RangeChainIo)
+		if !ok {
+			return errNoBatch
+		}
+		blocks, err = ranger.FilterRange(ctx, from, to, filter)
+		return err
+	})
+	if errors.Is(err, errNoBatch) {
+		return nil, services.ErrNotSupported
+	}
+	return blocks, err
+}
@@ -0,0 +1,170 @@
+package failover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/evolutionlandorg/block-scan/services"
+	"github.com/stretchr/testify/assert"
+)
+
+// node is a fake endpoint; head and fork decide what it answers.
+type node struct {
+	head  uint64
+	fork  bool
+	down  bool
+	calls int32
+}
+
+func (n *node) ReceiptLog(_ context.Context, tx string) (*services.Receipts, error) {
+	if err := n.call(); err != nil {
+		return nil, err
+	}
+	return &services.Receipts{BlockNumber: "1", Status: "0x1", BlockHash: n.hash(1)}, nil
+}
+
+func (n *node) BlockNumber(context.Context) (uint64, error) {
+	return n.head, n.call()
+}
+
+func (n *node) FilterTrans(_ context.Context, blockNum uint64, _ []string) (*services.BlockTrans, error) {
+	return &services.BlockTrans{Timestamp: blockNum}, n.call()
+}
+
+func (n *node) BlockHeader(_ context.Context, blockNum uint64) (*services.BlockHeader, error) {
+	if err := n.call(); err != nil {
+		return nil, err
+	}
+	if blockNum > n.head {
+		return nil, services.ErrNotAvailable
+	}
+	return &services.BlockHeader{Hash: n.hash(blockNum)}, nil
+}
+
+func (n *node) GetTransactionStatus(context.Context, string) (services.TxStatus, error) {
+	return services.TxStatusSuccess, n.call()
+}
+
+func (n *node) call() error {
+	atomic.AddInt32(&n.calls, 1)
+	if n.down {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (n *node) hash(blockNum uint64) string {
+	if n.fork {
+		return fmt.Sprintf("0xf%d", blockNum)
+	}
+	return fmt.Sprintf("0xb%d", blockNum)
+}
+
+// rangeNode is a node with range queries that refuses ranges of more than 10 blocks.
+type rangeNode struct {
+	node
+}
+
+func (n *rangeNode) FilterRange(_ context.Context, from, to uint64, _ []string) (map[uint64]*services.BlockTrans, error) {
+	if err := n.call(); err != nil {
+		return nil, err
+	}
+	if to-from >= 10 {
+		return nil, fmt.Errorf("query returned more than 10000 results: %w", services.ErrTooManyResults)
+	}
+	return map[uint64]*services.BlockTrans{from: {Timestamp: from}}, nil
+}
+
+func healthy(f *Failover) map[string]bool {
+	healthy := make(map[string]bool)
+	for _, s := range f.Status() {
+		healthy[s.Name] = s.Healthy
+	}
+	return healthy
+}
+
+func TestFailover(t *testing.T) {
+	ctx := context.Background()
+	a, b := &node{head: 100, down: true}, &node{head: 100}
+	f, err := New("Crab", Options{MaxFailures: 1, Cooldown: time.Hour}, Endpoint{Name: "a", ChainIo: a}, Endpoint{Name: "b", ChainIo: b})
+	assert.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		header, err := f.BlockHeader(ctx, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, "0xb10", header.Hash)
+	}
+	assert.Equal(t, map[string]bool{"a": false, "b": true}, healthy(f))
+	// a is skipped once it is unhealthy
+	assert.Equal(t, int32(1), atomic.LoadInt32(&a.calls))
+
+	// an unhealthy endpoint is still tried when nothing else is left
+	a.down, b.down = false, true
+	_, err = f.GetTransactionStatus(ctx, "0x1")
+	assert.NoError(t, err)
+}
+
+func TestFailoverTooManyResults(t *testing.T) {
+	ctx := context.Background()
+	a, b := &rangeNode{node{head: 100}}, &rangeNode{node{head: 100}}
+	f, err := New("Crab", Options{MaxFailures: 1, Cooldown: time.Hour}, Endpoint{Name: "a", ChainIo: a}, Endpoint{Name: "b", ChainIo: b})
+	assert.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err := f.FilterRange(ctx, 0, 99, nil)
+		assert.ErrorIs(t, err, services.ErrTooManyResults)
+	}
+	// the range is not sent to the other endpoint, and neither is marked unhealthy
+	assert.Equal(t, int32(3), atomic.LoadInt32(&a.calls)+atomic.LoadInt32(&b.calls))
+	assert.Equal(t, map[string]bool{"a": true, "b": true}, healthy(f))
+	for _, s := range f.Status() {
+		assert.Zero(t, s.ErrorRate)
+	}
+
+	blocks, err := f.FilterRange(ctx, 0, 9, nil)
+	assert.NoError(t, err)
+	assert.Len(t, blocks, 1)
+}
+
+func TestFailoverLag(t *testing.T) {
+	ctx := context.Background()
+	a, b, c := &node{head: 100}, &node{head: 98}, &node{head: 90}
+	f, err := New("Crab", Options{}, Endpoint{Name: "a", ChainIo: a}, Endpoint{Name: "b", ChainIo: b}, Endpoint{Name: "c", ChainIo: c})
+	assert.NoError(t, err)
+	head, err := f.BlockNumber(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(100), head)
+	assert.Equal(t, map[string]bool{"a": true, "b": true, "c": false}, healthy(f))
+}
+
+func TestFailoverQuorum(t *testing.T) {
+	ctx := context.Background()
+	a, b, c := &node{head: 100}, &node{head: 98}, &node{head: 100, fork: true}
+	f, err := New("Crab", Options{Quorum: 2}, Endpoint{Name: "a", ChainIo: a}, Endpoint{Name: "b", ChainIo: b}, Endpoint{Name: "c", ChainIo: c})
+	assert.NoError(t, err)
+
+	// the highest head two endpoints have reached
+	head, err := f.BlockNumber(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(100), head)
+
+	// only a has block 99 on the canonical chain, c is on a fork
+	_, err = f.BlockHeader(ctx, 99)
+	assert.ErrorIs(t, err, services.ErrNotAvailable)
+
+	header, err := f.BlockHeader(ctx, 98)
+	assert.NoError(t, err)
+	assert.Equal(t, "0xb98", header.Hash)
+	assert.Equal(t, map[string]bool{"a": true, "b": true, "c": false}, healthy(f))
+
+	receipt, err := f.ReceiptLog(ctx, "0x1")
+	assert.NoError(t, err)
+	assert.Equal(t, "0xb1", receipt.BlockHash)
+
+	_, err = New("Crab", Options{Quorum: 4}, Endpoint{Name: "a", ChainIo: a})
+	assert.Error(t, err)
+}
@@ -0,0 +1,159 @@
+package block_scan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/evolutionlandorg/block-scan/services"
+)
+
+type ScannerState string
+
+var (
+	ScannerStateRunning ScannerState = "running"
+	ScannerStatePaused  ScannerState = "paused"
+	ScannerStateStopped ScannerState = "stopped"
+)
+
+type ScannerStatus struct {
+	Chain string
+	State ScannerState
+	// BlockNum is the last block the scanner has scanned
+	BlockNum uint64
+	// Err is the error the scanner stopped with
+	Err error
+}
+
+// ScannerHandle controls a scanner started by StartScanner.
+type ScannerHandle struct {
+	scanType ScanType
+	opt      services.ScanEventsOptions
+	control  *services.Control
+	cancel   context.CancelFunc
+	done     chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+// StartScanner starts the scanner in the background and returns a handle to control it.
+// RunForever and RestartPolicy are honoured as in StartScanChainEvents.
+func StartScanner(ctx context.Context, scanType ScanType, opt services.ScanEventsOptions) (*ScannerHandle, error) {
+	if _, err := newScanInstance(scanType); err != nil {
+		return nil, err
+	}
+	if err := opt.Check(); err != nil {
+		return nil, err
+	}
+	if opt.Control == nil {
+		opt.Control = services.NewControl()
+	}
+	h := &ScannerHandle{
+		scanType: scanType,
+		opt:      opt,
+		control:  opt.Control,
+		done:     make(chan struct{}),
+	}
+	ctx, h.cancel = context.WithCancel(ctx)
+	go func() {
+		defer close(h.done)
+		var err error
+		if opt.RunForever {
+			err = runForever(ctx, scanType, opt, nil)
+		} else {
+			err = runScanner(ctx, scanType, opt)
+		}
+		h.mu.Lock()
+		h.err = err
+		h.mu.Unlock()
+	}()
+	return h, nil
+}
+
+// Pause stops the scanner from scanning new blocks until Resume is called.
+func (h *ScannerHandle) Pause() {
+	h.control.Pause()
+}
+
+func (h *ScannerHandle) Resume() {
+	h.control.Resume()
+}
+
+// Rescan delivers the events in [from, to] again. The checkpoint is not moved.
+func (h *ScannerHandle) Rescan(from, to uint64) error {
+	if from > to {
+		return fmt.Errorf("invalid rescan range %d-%d", from, to)
+	}
+	h.control.Rescan(from, to)
+	return nil
+}
+
+// SetCheckpoint stores blockNum as the checkpoint and makes the running scanner continue from it.
+// A BACKFILL scanner has no live checkpoint to set.
+func (h *ScannerHandle) SetCheckpoint(blockNum uint64) error {
+	if h.scanType == BACKFILL {
+		return errors.New("a backfill does not use the live checkpoint, set Backfill.SetStartBlock instead")
+	}
+	h.opt.RewindStartBlock(blockNum)
+	h.control.SetCheckpoint(blockNum)
+	return nil
+}
+
+// DeadLetters lists the transactions whose receipts never became available.
+func (h *ScannerHandle) DeadLetters() ([]services.DeadLetter, error) {
+	return h.opt.DeadLetterStore.List(h.opt.Chain)
+}
+
+// ReplayDeadLetters asks the scanner to retry every dead-lettered transaction once.
+func (h *ScannerHandle) ReplayDeadLetters() {
+	h.control.ReplayDeadLetters()
+}
+
+func (h *ScannerHandle) Status() ScannerStatus {
+	status := ScannerStatus{
+		Chain:    h.opt.Chain,
+		State:    ScannerStateRunning,
+		BlockNum: h.control.Progress(),
+	}
+	select {
+	case <-h.done:
+		status.State = ScannerStateStopped
+		status.Err = h.Err()
+		return status
+	default:
+	}
+	if h.control.Paused() {
+		status.State = ScannerStatePaused
+	}
+	return status
+}
+
+// Stop stops the scanner and waits for it to exit or for ctx to be done.
+func (h *ScannerHandle) Stop(ctx context.Context) error {
+	h.cancel()
+	select {
+	case <-h.done:
+		return h.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Wait blocks until the scanner has stopped and returns its error.
+func (h *ScannerHandle) Wait() error {
+	<-h.done
+	return h.Err()
+}
+
+// Done is closed once the scanner has stopped.
+func (h *ScannerHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+func (h *ScannerHandle) Err() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err
+}
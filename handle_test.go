@@ -0,0 +1,84 @@
+package block_scan
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/evolutionlandorg/block-scan/services"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScannerHandle(t *testing.T) {
+	var (
+		delivered  int64
+		checkpoint uint64
+	)
+	h, err := StartScanner(context.Background(), POLLING, services.ScanEventsOptions{
+		ChainIo:       new(MockChainIo),
+		GetStartBlock: func() uint64 { return 1 },
+		SetStartBlock: func(currentBlockNum uint64) {
+			atomic.StoreUint64(&checkpoint, currentBlockNum)
+		},
+		Chain: "Crab",
+		ContractsName: map[services.ContractsAddress]services.ContractsName{
+			services.ContractsAddress("222"): services.ContractsName("fake"),
+		},
+		GetCallbackFunc: func(tx string, blockTimestamp uint64, receipt *services.Receipts) interface{} {
+			atomic.AddInt64(&delivered, 1)
+			return new(FakeCallback)
+		},
+		CallbackMethodPrefix: []string{"Fake"},
+	})
+	assert.NoError(t, err)
+
+	// blocks 2-10 are scanned on start
+	assert.Eventually(t, func() bool { return atomic.LoadInt64(&delivered) == 9 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, uint64(10), h.Status().BlockNum)
+
+	h.Pause()
+	assert.Equal(t, ScannerStatePaused, h.Status().State)
+	assert.Error(t, h.Rescan(3, 2))
+	assert.NoError(t, h.Rescan(2, 3))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int64(9), atomic.LoadInt64(&delivered))
+
+	h.Resume()
+	assert.Equal(t, ScannerStateRunning, h.Status().State)
+	assert.Eventually(t, func() bool { return atomic.LoadInt64(&delivered) == 11 }, 5*time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, h.SetCheckpoint(7))
+	assert.Equal(t, uint64(7), atomic.LoadUint64(&checkpoint))
+	// blocks 8-10 are scanned again
+	assert.Eventually(t, func() bool { return atomic.LoadInt64(&delivered) == 14 }, 5*time.Second, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, h.Stop(ctx))
+	assert.Equal(t, ScannerStateStopped, h.Status().State)
+}
+
+func TestScannerHandleBackfillCheckpoint(t *testing.T) {
+	var checkpoint uint64
+	h, err := StartScanner(context.Background(), BACKFILL, services.ScanEventsOptions{
+		ChainIo:       new(MockChainIo),
+		GetStartBlock: func() uint64 { return 0 },
+		SetStartBlock: func(currentBlockNum uint64) {
+			atomic.StoreUint64(&checkpoint, currentBlockNum)
+		},
+		Chain: "Crab",
+		ContractsName: map[services.ContractsAddress]services.ContractsName{
+			services.ContractsAddress("222"): services.ContractsName("fake"),
+		},
+		GetCallbackFunc: func(string, uint64, *services.Receipts) interface{} {
+			return new(FakeCallback)
+		},
+		CallbackMethodPrefix: []string{"Fake"},
+		Backfill:             services.BackfillOptions{From: 1, To: 5},
+	})
+	assert.NoError(t, err)
+	assert.Error(t, h.SetCheckpoint(3))
+	assert.NoError(t, h.Wait())
+	assert.Zero(t, atomic.LoadUint64(&checkpoint))
+}
@@ -0,0 +1,154 @@
+package hybrid
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/evolutionlandorg/block-scan/metrics"
+	"github.com/evolutionlandorg/block-scan/services"
+	"github.com/evolutionlandorg/block-scan/subscribe"
+	"github.com/evolutionlandorg/block-scan/util"
+	"github.com/evolutionlandorg/block-scan/util/log"
+	"github.com/spf13/cast"
+)
+
+// dedupeWindow is how many blocks behind the newest delivered transaction are remembered
+const dedupeWindow = 1000
+
+// Hybrid reads new logs from the {CHAIN}_WSS_RPC subscription while it is healthy
+// and falls back to polling ChainIo when the socket drops. Both modes resume after
+// the checkpoint block. Transactions a mode delivered past the checkpoint are
+// remembered, so the other mode does not deliver them again.
+type Hybrid struct {
+	*subscribe.Subscribe
+	metrics metrics.Metrics
+
+	mu        sync.Mutex
+	delivered map[string]uint64
+	newest    uint64
+}
+
+func (h *Hybrid) SetMetrics(metrics metrics.Metrics) {
+	h.metrics = metrics
+	if h.Subscribe != nil {
+		h.Subscribe.SetMetrics(metrics)
+	}
+}
+
+func (h *Hybrid) Init(opt services.ScanEventsOptions) error {
+	if h.Subscribe == nil {
+		h.Subscribe = new(subscribe.Subscribe)
+		h.Subscribe.SetMetrics(h.metrics)
+	}
+	h.delivered = make(map[string]uint64)
+	opt.AfterPushMiddleware = append(append([]services.AfterPushFunc{}, opt.AfterPushMiddleware...), h.sent)
+	if err := h.Subscribe.Init(opt); err != nil {
+		return err
+	}
+	h.Polling.Delivered = h.seen
+	return nil
+}
+
+// seen reports transactions that were already delivered by either mode.
+func (h *Hybrid) seen(tx string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, ok := h.delivered[tx]
+	return ok
+}
+
+// sent records a delivered transaction. It runs only after the Sink accepted every event of tx,
+// so a transaction the Sink failed is sent again when it is retried.
+func (h *Hybrid) sent(tx string, _ uint64, receipt *services.Receipts) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	blockNum := cast.ToUint64(receipt.BlockNumber)
+	h.delivered[tx] = blockNum
+	if blockNum > h.newest {
+		h.newest = blockNum
+		for k, v := range h.delivered {
+			if v+dedupeWindow < h.newest {
+				delete(h.delivered, k)
+			}
+		}
+	}
+}
+
+func (h *Hybrid) WipeBlock(ctx context.Context) error {
+	for {
+		err := h.Subscribe.WipeBlock(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		log.Warn("%s subscription stopped: %v. switching to polling", h.Opt.Chain, err)
+		if err := h.poll(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		log.Info("%s websocket is back, switching to subscription", h.Opt.Chain)
+	}
+}
+
+// poll scans new blocks through ChainIo until the websocket endpoint answers again.
+func (h *Hybrid) poll(ctx context.Context) error {
+	checkpoint, err := h.Opt.StartBlock(ctx)
+	if err != nil {
+		return err
+	}
+	if checkpoint == 0 {
+		checkpoint = h.Opt.InitBlock
+	}
+	// the checkpoint block is already done
+	h.Checkpoint().Reset(checkpoint)
+	next := checkpoint + 1
+	sleepTime := util.GetSleepTime()
+	for {
+		if err := h.HandleControl(ctx); err != nil {
+			return err
+		}
+		if blockNum, ok := h.Opt.Control.TakeCheckpoint(); ok {
+			h.Checkpoint().Reset(blockNum)
+			next = blockNum + 1
+		}
+		head, err := h.Opt.ChainIoV2.BlockNumber(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Warn("%s get block number error: %v", h.Opt.Chain, err)
+		}
+		if head = h.Opt.ConfirmedHead(head); head >= next && head != 0 {
+			if err := h.ScanBlocks(ctx, next, head, false); err != nil {
+				if ctx.Err() != nil {
+					return err
+				}
+				log.Warn("%s polling block %d-%d error: %v", h.Opt.Chain, next, head, err)
+			} else {
+				h.Opt.Control.SetProgress(head)
+				h.Opt.CaughtUp(head)
+				next = head + 1
+			}
+		}
+		if h.reachable(ctx) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(sleepTime):
+		}
+	}
+}
+
+func (h *Hybrid) reachable(ctx context.Context) bool {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	client, err := ethclient.DialContext(ctx, h.Endpoint())
+	if err != nil {
+		return false
+	}
+	defer client.Close()
+	_, err = client.BlockNumber(ctx)
+	return err == nil
+}
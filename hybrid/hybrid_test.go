@@ -0,0 +1,162 @@
+package hybrid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/evolutionlandorg/block-scan/metrics"
+	"github.com/evolutionlandorg/block-scan/services"
+	"github.com/stretchr/testify/assert"
+)
+
+type chainIo struct{}
+
+func (c *chainIo) ReceiptLog(tx string) (*services.Receipts, error) {
+	var blockNum uint64
+	_, _ = fmt.Sscanf(tx, "0x%d", &blockNum)
+	return &services.Receipts{
+		BlockNumber: fmt.Sprint(blockNum),
+		Logs:        []services.Log{{Topics: []string{"0x1"}, Data: tx, Address: "0x222"}},
+		Status:      "0x1",
+		ChainSource: "Crab",
+	}, nil
+}
+
+func (c *chainIo) BlockNumber() uint64 {
+	return 10
+}
+
+func (c *chainIo) FilterTrans(blockNum uint64, _ []string) ([]string, []string, uint64, []string) {
+	return []string{fmt.Sprintf("0x%d", blockNum)}, []string{"0x222"}, blockNum, []string{"0x222"}
+}
+
+func (c *chainIo) BlockHeader(blockNum uint64) *services.BlockHeader {
+	return &services.BlockHeader{BlockTimeStamp: blockNum}
+}
+
+func (c *chainIo) GetTransactionStatus(_ string) string {
+	return "0x1"
+}
+
+func TestHybridPollingFallback(t *testing.T) {
+	assert.NoError(t, os.Setenv("CRAB_WSS_RPC", "ws://127.0.0.1:1"))
+	var (
+		mu        sync.Mutex
+		delivered = make(map[string]int)
+	)
+	h := new(Hybrid)
+	h.SetMetrics(metrics.NewMetrics())
+	assert.NoError(t, h.Init(services.ScanEventsOptions{
+		ChainIo:       new(chainIo),
+		Chain:         "Crab",
+		GetStartBlock: func() uint64 { return 3 },
+		SetStartBlock: func(uint64) {},
+		ContractsName: map[services.ContractsAddress]services.ContractsName{"0x222": "fake"},
+		GetCallbackFunc: func(tx string, _ uint64, _ *services.Receipts) interface{} {
+			mu.Lock()
+			defer mu.Unlock()
+			delivered[tx]++
+			return nil
+		},
+		CallbackMethodPrefix: []string{"fake"},
+	}))
+	// checkpoint block 3 is done, even after a restart that forgot what was delivered
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, h.WipeBlock(ctx))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, delivered, 7)
+	assert.NotContains(t, delivered, "0x3")
+	for i := 4; i <= 10; i++ {
+		assert.Equal(t, 1, delivered[fmt.Sprintf("0x%d", i)])
+	}
+}
+
+func TestHybridSinkRetry(t *testing.T) {
+	assert.NoError(t, os.Setenv("CRAB_WSS_RPC", "ws://127.0.0.1:1"))
+	var (
+		mu     sync.Mutex
+		failed bool
+		sent   = make(map[string]int)
+	)
+	h := new(Hybrid)
+	h.SetMetrics(metrics.NewMetrics())
+	assert.NoError(t, h.Init(services.ScanEventsOptions{
+		ChainIo:         new(chainIo),
+		Chain:           "Crab",
+		GetStartBlock:   func() uint64 { return 4 },
+		SetStartBlock:   func(uint64) {},
+		ContractsName:   map[services.ContractsAddress]services.ContractsName{"0x222": "fake"},
+		GetCallbackFunc: func(string, uint64, *services.Receipts) interface{} { return nil },
+		Sink: services.SinkFunc(func(_ context.Context, fb *services.FilterBlock) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if fb.Txid == "0x6" && !failed {
+				failed = true
+				return errors.New("sink is down")
+			}
+			sent[fb.Txid]++
+			return nil
+		}),
+		CallbackMethodPrefix: []string{"fake"},
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	assert.NoError(t, h.WipeBlock(ctx))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.True(t, failed)
+	assert.Len(t, sent, 6)
+	for i := 5; i <= 10; i++ {
+		assert.Equal(t, 1, sent[fmt.Sprintf("0x%d", i)])
+	}
+}
+
+func TestHybridRescan(t *testing.T) {
+	assert.NoError(t, os.Setenv("CRAB_WSS_RPC", "ws://127.0.0.1:1"))
+	var (
+		mu        sync.Mutex
+		delivered = make(map[string]int)
+		control   = services.NewControl()
+	)
+	h := new(Hybrid)
+	h.SetMetrics(metrics.NewMetrics())
+	assert.NoError(t, h.Init(services.ScanEventsOptions{
+		ChainIo:       new(chainIo),
+		Chain:         "Crab",
+		GetStartBlock: func() uint64 { return 3 },
+		SetStartBlock: func(uint64) {},
+		ContractsName: map[services.ContractsAddress]services.ContractsName{"0x222": "fake"},
+		GetCallbackFunc: func(tx string, _ uint64, _ *services.Receipts) interface{} {
+			mu.Lock()
+			defer mu.Unlock()
+			delivered[tx]++
+			return nil
+		},
+		CallbackMethodPrefix: []string{"fake"},
+		Control:              control,
+	}))
+	// delivered before, then rescanned
+	h.sent("0x5", 5, &services.Receipts{BlockNumber: "5"})
+	h.sent("0x6", 6, &services.Receipts{BlockNumber: "6"})
+	control.Rescan(5, 6)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, h.WipeBlock(ctx))
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i := 4; i <= 10; i++ {
+		assert.Equal(t, 1, delivered[fmt.Sprintf("0x%d", i)], i)
+	}
+}
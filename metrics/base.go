@@ -34,6 +34,8 @@ func init() {
 type Metrics interface {
 	ScanTxTotal(network string, value ...float64)
 	ScanCallbackTotal(network string, value ...float64)
+	ScanRestartTotal(network string, value ...float64)
+	ScanThrottleSeconds(network string, value ...float64)
 }
 
 func NewMetrics() Metrics {
@@ -15,3 +15,9 @@ func (f FakeMetrics) ScanCallbackTotal(_ string, _ ...float64) {
 
 func (f FakeMetrics) ScanCallbackErrorTotal(_ string, _ ...float64) {
 }
+
+func (f FakeMetrics) ScanRestartTotal(_ string, _ ...float64) {
+}
+
+func (f FakeMetrics) ScanThrottleSeconds(_ string, _ ...float64) {
+}
@@ -7,6 +7,9 @@ import (
 type PrometheusMetrics struct {
 	scanTxTotal       *prometheus.CounterVec
 	scanCallbackTotal *prometheus.CounterVec
+	scanRestartTotal  *prometheus.CounterVec
+	// scanThrottleSeconds is the time ChainIo calls waited for a rate limit
+	scanThrottleSeconds *prometheus.CounterVec
 }
 
 func (p PrometheusMetrics) ScanTxTotal(network string, value ...float64) {
@@ -25,14 +28,32 @@ func (p PrometheusMetrics) ScanCallbackTotal(network string, value ...float64) {
 	p.scanCallbackTotal.With(prometheus.Labels{"network": network}).Add(v)
 }
 
+func (p PrometheusMetrics) ScanRestartTotal(network string, value ...float64) {
+	var v = 1.0
+	if len(value) > 0 {
+		v = value[0]
+	}
+	p.scanRestartTotal.With(prometheus.Labels{"network": network}).Add(v)
+}
+
+func (p PrometheusMetrics) ScanThrottleSeconds(network string, value ...float64) {
+	var v = 1.0
+	if len(value) > 0 {
+		v = value[0]
+	}
+	p.scanThrottleSeconds.With(prometheus.Labels{"network": network}).Add(v)
+}
+
 func newPrometheusMetrics() *PrometheusMetrics {
 	var labelNames = []string{
 		"network",
 	}
 	l := &PrometheusMetrics{
-		scanTxTotal:       prometheus.NewCounterVec(prometheus.CounterOpts{Name: "scan_tx_total", Help: "The total number of scan tx"}, labelNames),
-		scanCallbackTotal: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "scan_callback_total", Help: "The total number of scan callback"}, labelNames),
+		scanTxTotal:         prometheus.NewCounterVec(prometheus.CounterOpts{Name: "scan_tx_total", Help: "The total number of scan tx"}, labelNames),
+		scanCallbackTotal:   prometheus.NewCounterVec(prometheus.CounterOpts{Name: "scan_callback_total", Help: "The total number of scan callback"}, labelNames),
+		scanRestartTotal:    prometheus.NewCounterVec(prometheus.CounterOpts{Name: "scan_restart_total", Help: "The total number of scanner restarts"}, labelNames),
+		scanThrottleSeconds: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "scan_throttle_seconds_total", Help: "The total seconds ChainIo calls waited for the rate limit"}, labelNames),
 	}
-	prometheus.MustRegister(l.scanTxTotal, l.scanCallbackTotal)
+	prometheus.MustRegister(l.scanTxTotal, l.scanCallbackTotal, l.scanRestartTotal, l.scanThrottleSeconds)
 	return l
 }
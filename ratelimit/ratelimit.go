@@ -0,0 +1,279 @@
+// Package ratelimit limits the rate and concurrency of the ChainIo calls of a chain.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/evolutionlandorg/block-scan/metrics"
+	"github.com/evolutionlandorg/block-scan/services"
+)
+
+type Options struct {
+	// Rate is how many calls per second are allowed. 0 means no rate limit
+	Rate float64
+	// Burst is how many calls can be made at once after a quiet period. Default 1
+	Burst int
+	// MaxConcurrent is how many calls can be in flight at the same time. 0 means no limit
+	MaxConcurrent int
+}
+
+type waiter struct {
+	priority services.Priority
+	// cost is taken from the bucket once it holds need tokens, so a batch larger than
+	// the burst still goes through and leaves the bucket in debt
+	cost    float64
+	need    float64
+	ready   chan struct{}
+	granted bool
+}
+
+// Limiter is a services.ChainIoV2 middleware with a token bucket and a concurrency cap.
+// Waiting calls are let through by services.Priority, then in arrival order, so head-following
+// calls go before backfill calls.
+type Limiter struct {
+	chainIo services.ChainIoV2
+	chain   string
+	opt     Options
+	metrics metrics.Metrics
+
+	mu       sync.Mutex
+	tokens   float64
+	last     time.Time
+	inflight int
+	waiters  []*waiter
+	timer    *time.Timer
+}
+
+var (
+	_ services.ChainIoV2    = (*Limiter)(nil)
+	_ services.BatchChainIo = (*batchLimiter)(nil)
+	_ services.RangeChainIo = (*rangeLimiter)(nil)
+	_ services.BatchChainIo = (*batchRangeLimiter)(nil)
+	_ services.RangeChainIo = (*batchRangeLimiter)(nil)
+)
+
+// New returns a *Limiter for chainIo. If chainIo has batch calls or range queries, the Limiter is
+// wrapped in a type that has them as well, so scanners take the same paths as without the limiter.
+// Every returned value has the SetMetrics method of the Limiter.
+func New(chain string, chainIo services.ChainIoV2, opt Options) services.ChainIoV2 {
+	if opt.Burst <= 0 {
+		opt.Burst = 1
+	}
+	l := &Limiter{
+		chainIo: chainIo,
+		chain:   chain,
+		opt:     opt,
+		metrics: metrics.NewMetrics(),
+		tokens:  float64(opt.Burst),
+		last:    time.Now(),
+	}
+	batch, isBatch := chainIo.(services.BatchChainIo)
+	ranger, isRange := chainIo.(services.RangeChainIo)
+	switch {
+	case isBatch && isRange:
+		return &batchRangeLimiter{batchLimiter: batchLimiter{Limiter: l, batch: batch}, ranger: ranger}
+	case isBatch:
+		return &batchLimiter{Limiter: l, batch: batch}
+	case isRange:
+		return &rangeLimiter{Limiter: l, ranger: ranger}
+	}
+	return l
+}
+
+func (l *Limiter) SetMetrics(metrics metrics.Metrics) {
+	l.metrics = metrics
+}
+
+// acquire waits until n tokens and a concurrency slot are available, or ctx is done.
+func (l *Limiter) acquire(ctx context.Context, n int) (release func(), err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	w := &waiter{
+		priority: services.PriorityFrom(ctx),
+		cost:     float64(n),
+		need:     math.Min(float64(n), float64(l.opt.Burst)),
+		ready:    make(chan struct{}),
+	}
+	start := time.Now()
+	l.mu.Lock()
+	l.waiters = append(l.waiters, w)
+	l.dispatch()
+	l.mu.Unlock()
+
+	select {
+	case <-w.ready:
+	case <-ctx.Done():
+		l.mu.Lock()
+		granted := w.granted
+		if !granted {
+			l.remove(w)
+			l.dispatch()
+		}
+		l.mu.Unlock()
+		if granted {
+			l.release()
+		}
+		return nil, ctx.Err()
+	}
+	if wait := time.Since(start); wait > time.Millisecond {
+		l.metrics.ScanThrottleSeconds(l.chain, wait.Seconds())
+	}
+	var once sync.Once
+	return func() { once.Do(l.release) }, nil
+}
+
+func (l *Limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inflight--
+	l.dispatch()
+}
+
+func (l *Limiter) remove(w *waiter) {
+	for i, v := range l.waiters {
+		if v == w {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// dispatch grants waiters in priority order while tokens and slots last, and sets a timer
+// for the next token otherwise. It must be called with l.mu held.
+func (l *Limiter) dispatch() {
+	for len(l.waiters) > 0 {
+		next := l.waiters[0]
+		for _, w := range l.waiters[1:] {
+			if w.priority < next.priority {
+				next = w
+			}
+		}
+		if l.opt.MaxConcurrent > 0 && l.inflight >= l.opt.MaxConcurrent {
+			return
+		}
+		if l.opt.Rate > 0 {
+			now := time.Now()
+			l.tokens = math.Min(float64(l.opt.Burst), l.tokens+now.Sub(l.last).Seconds()*l.opt.Rate)
+			l.last = now
+			if l.tokens < next.need {
+				if l.timer == nil {
+					wait := time.Duration((next.need - l.tokens) / l.opt.Rate * float64(time.Second))
+					l.timer = time.AfterFunc(wait, func() {
+						l.mu.Lock()
+						defer l.mu.Unlock()
+						l.timer = nil
+						l.dispatch()
+					})
+				}
+				return
+			}
+			l.tokens -= next.cost
+		}
+		l.inflight++
+		next.granted = true
+		close(next.ready)
+		l.remove(next)
+	}
+}
+
+func (l *Limiter) ReceiptLog(ctx context.Context, tx string) (*services.Receipts, error) {
+	release, err := l.acquire(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return l.chainIo.ReceiptLog(ctx, tx)
+}
+
+func (l *Limiter) BlockNumber(ctx context.Context) (uint64, error) {
+	release, err := l.acquire(ctx, 1)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	return l.chainIo.BlockNumber(ctx)
+}
+
+func (l *Limiter) FilterTrans(ctx context.Context, blockNum uint64, filter []string) (*services.BlockTrans, error) {
+	release, err := l.acquire(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return l.chainIo.FilterTrans(ctx, blockNum, filter)
+}
+
+func (l *Limiter) BlockHeader(ctx context.Context, blockNum uint64) (*services.BlockHeader, error) {
+	release, err := l.acquire(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return l.chainIo.BlockHeader(ctx, blockNum)
+}
+
+func (l *Limiter) GetTransactionStatus(ctx context.Context, tx string) (services.TxStatus, error) {
+	release, err := l.acquire(ctx, 1)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	return l.chainIo.GetTransactionStatus(ctx, tx)
+}
+
+// batchLimiter is a Limiter over a ChainIoV2 with batch calls. A batch takes one token per element.
+type batchLimiter struct {
+	*Limiter
+	batch services.BatchChainIo
+}
+
+func (l *batchLimiter) ReceiptLogs(ctx context.Context, txs []string) ([]*services.Receipts, error) {
+	release, err := l.acquire(ctx, len(txs))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return l.batch.ReceiptLogs(ctx, txs)
+}
+
+func (l *batchLimiter) BlockHeaders(ctx context.Context, nums []uint64) ([]*services.BlockHeader, error) {
+	release, err := l.acquire(ctx, len(nums))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return l.batch.BlockHeaders(ctx, nums)
+}
+
+// rangeLimiter is a Limiter over a ChainIoV2 with range queries. A range query takes one token.
+type rangeLimiter struct {
+	*Limiter
+	ranger services.RangeChainIo
+}
+
+func (l *rangeLimiter) FilterRange(ctx context.Context, from, to uint64, filter []string) (map[uint64]*services.BlockTrans, error) {
+	return l.filterRange(ctx, l.ranger, from, to, filter)
+}
+
+// batchRangeLimiter is a Limiter over a ChainIoV2 with both batch calls and range queries.
+type batchRangeLimiter struct {
+	batchLimiter
+	ranger services.RangeChainIo
+}
+
+func (l *batchRangeLimiter) FilterRange(ctx context.Context, from, to uint64, filter []string) (map[uint64]*services.BlockTrans, error) {
+	return l.filterRange(ctx, l.ranger, from, to, filter)
+}
+
+func (l *Limiter) filterRange(ctx context.Context, ranger services.RangeChainIo, from, to uint64, filter []string) (map[uint64]*services.BlockTrans, error) {
+	release, err := l.acquire(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return ranger.FilterRange(ctx, from, to, filter)
+}
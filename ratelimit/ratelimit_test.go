@@ -0,0 +1,150 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/evolutionlandorg/block-scan/metrics"
+	"github.com/evolutionlandorg/block-scan/services"
+	"github.com/stretchr/testify/assert"
+)
+
+// slowChainIo records the order of ReceiptLog calls and blocks each one until release is closed.
+type slowChainIo struct {
+	services.ChainIoV2
+	release  chan struct{}
+	inflight int32
+	max      int32
+	mu       sync.Mutex
+	order    []string
+}
+
+func (c *slowChainIo) ReceiptLog(_ context.Context, tx string) (*services.Receipts, error) {
+	n := atomic.AddInt32(&c.inflight, 1)
+	defer atomic.AddInt32(&c.inflight, -1)
+	for {
+		max := atomic.LoadInt32(&c.max)
+		if n <= max || atomic.CompareAndSwapInt32(&c.max, max, n) {
+			break
+		}
+	}
+	c.mu.Lock()
+	c.order = append(c.order, tx)
+	c.mu.Unlock()
+	<-c.release
+	return &services.Receipts{}, nil
+}
+
+func (c *slowChainIo) BlockNumber(context.Context) (uint64, error) {
+	return 1, nil
+}
+
+func TestLimiterRate(t *testing.T) {
+	l := New("Crab", new(slowChainIo), Options{Rate: 100, Burst: 2})
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		_, err := l.BlockNumber(context.Background())
+		assert.NoError(t, err)
+	}
+	// 2 at once, then 8 at 100 per second
+	assert.GreaterOrEqual(t, time.Since(start), 70*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	l = New("Crab", new(slowChainIo), Options{Rate: 1})
+	_, _ = l.BlockNumber(ctx)
+	_, err := l.BlockNumber(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestLimiterConcurrency(t *testing.T) {
+	c := &slowChainIo{release: make(chan struct{})}
+	l := New("Crab", c, Options{MaxConcurrent: 2})
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = l.ReceiptLog(context.Background(), "0x1")
+		}()
+	}
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&c.inflight) == 2 }, time.Second, time.Millisecond)
+	close(c.release)
+	wg.Wait()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&c.max))
+}
+
+func TestLimiterPriority(t *testing.T) {
+	c := &slowChainIo{release: make(chan struct{})}
+	l := New("Crab", c, Options{MaxConcurrent: 1}).(*Limiter)
+	ctx := context.Background()
+	backfill := services.WithPriority(ctx, services.PriorityBackfill)
+
+	var wg sync.WaitGroup
+	call := func(ctx context.Context, tx string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = l.ReceiptLog(ctx, tx)
+		}()
+	}
+	waiting := func(n int) func() bool {
+		return func() bool {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			return len(l.waiters) == n
+		}
+	}
+	call(ctx, "first")
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&c.inflight) == 1 }, time.Second, time.Millisecond)
+	call(backfill, "backfill")
+	assert.Eventually(t, waiting(1), time.Second, time.Millisecond)
+	call(ctx, "head")
+	assert.Eventually(t, waiting(2), time.Second, time.Millisecond)
+
+	close(c.release)
+	wg.Wait()
+	assert.Equal(t, []string{"first", "head", "backfill"}, c.order)
+}
+
+type batchChainIo struct {
+	services.ChainIoV2
+}
+
+func (c *batchChainIo) ReceiptLogs(context.Context, []string) ([]*services.Receipts, error) {
+	return nil, nil
+}
+
+func (c *batchChainIo) BlockHeaders(context.Context, []uint64) ([]*services.BlockHeader, error) {
+	return nil, nil
+}
+
+type rangeChainIo struct {
+	batchChainIo
+}
+
+func (c *rangeChainIo) FilterRange(context.Context, uint64, uint64, []string) (map[uint64]*services.BlockTrans, error) {
+	return nil, nil
+}
+
+func TestLimiterCapabilities(t *testing.T) {
+	for _, tt := range []struct {
+		chainIo       services.ChainIoV2
+		batch, ranger bool
+	}{
+		{new(slowChainIo), false, false},
+		{new(batchChainIo), true, false},
+		{new(rangeChainIo), true, true},
+	} {
+		l := New("Crab", tt.chainIo, Options{})
+		_, batch := l.(services.BatchChainIo)
+		_, ranger := l.(services.RangeChainIo)
+		assert.Equal(t, tt.batch, batch)
+		assert.Equal(t, tt.ranger, ranger)
+		_, ok := l.(interface{ SetMetrics(metrics.Metrics) })
+		assert.True(t, ok)
+	}
+}
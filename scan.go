@@ -2,32 +2,144 @@ package block_scan
 
 import (
 	"context"
+	"fmt"
 	"github.com/evolutionlandorg/block-scan/metrics"
+	"sync"
 	"time"
 
+	"github.com/evolutionlandorg/block-scan/backfill"
+	"github.com/evolutionlandorg/block-scan/hybrid"
 	"github.com/evolutionlandorg/block-scan/scan"
 	"github.com/evolutionlandorg/block-scan/services"
 	"github.com/evolutionlandorg/block-scan/subscribe"
-	"github.com/evolutionlandorg/block-scan/util"
 	"github.com/evolutionlandorg/block-scan/util/log"
 )
 
 type ScanType string
 
+// ScanFactory returns a new, uninitialised services.Scan instance.
+type ScanFactory func() services.Scan
+
 var (
 	SUBSCRIBE ScanType = "subscribe"
 	POLLING   ScanType = "polling"
+	// HYBRID subscribes to {CHAIN}_WSS_RPC and polls ChainIo while the websocket is down
+	HYBRID ScanType = "hybrid"
+	// BACKFILL scans ScanEventsOptions.Backfill with parallel workers and returns once it is done
+	BACKFILL ScanType = "backfill"
 )
 
+var (
+	scanTypesMu sync.RWMutex
+	scanTypes   = make(map[ScanType]ScanFactory)
+)
+
+func init() {
+	RegisterScanType(SUBSCRIBE, func() services.Scan { return new(subscribe.Subscribe) })
+	RegisterScanType(POLLING, func() services.Scan { return new(scan.Polling) })
+	RegisterScanType(HYBRID, func() services.Scan { return new(hybrid.Hybrid) })
+	RegisterScanType(BACKFILL, func() services.Scan { return new(backfill.Backfill) })
+}
+
+// RegisterScanType makes a services.Scan implementation available to
+// StartScanChainEvents under the given name.
+// It panics if factory is nil or if name is already registered.
+func RegisterScanType(name ScanType, factory ScanFactory) {
+	scanTypesMu.Lock()
+	defer scanTypesMu.Unlock()
+	if factory == nil {
+		panic(fmt.Sprintf("block-scan: RegisterScanType factory for '%s' is nil", name))
+	}
+	if _, ok := scanTypes[name]; ok {
+		panic(fmt.Sprintf("block-scan: RegisterScanType called twice for '%s'", name))
+	}
+	scanTypes[name] = factory
+}
+
+// ScanTypes returns the names of all registered scan types.
+func ScanTypes() []ScanType {
+	scanTypesMu.RLock()
+	defer scanTypesMu.RUnlock()
+	var names []ScanType
+	for name := range scanTypes {
+		names = append(names, name)
+	}
+	return names
+}
+
+func newScanInstance(scanType ScanType) (services.Scan, error) {
+	scanTypesMu.RLock()
+	factory, ok := scanTypes[scanType]
+	scanTypesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("not implement '%s' type", scanType)
+	}
+	return factory(), nil
+}
+
+// StartScanChainEvents runs the scanner and blocks until it stops. Use StartScanner to control it while it runs.
 func StartScanChainEvents(ctx context.Context, scanType ScanType, opt services.ScanEventsOptions) error {
-	var instance services.Scan
-	switch scanType {
-	case SUBSCRIBE:
-		instance = new(subscribe.Subscribe)
-	case POLLING:
-		instance = new(scan.Polling)
-	default:
-		log.Panic("not implement '%s' type", scanType)
+	h, err := StartScanner(ctx, scanType, opt)
+	if err != nil {
+		return err
+	}
+	return h.Wait()
+}
+
+// runForever runs the scanner until ctx is done or the scanner returns nil, restarting it
+// according to opt.RestartPolicy whenever it fails. onStart, if not nil, is called before each run.
+func runForever(ctx context.Context, scanType ScanType, opt services.ScanEventsOptions, onStart func()) error {
+	if _, err := newScanInstance(scanType); err != nil {
+		return err
+	}
+	if err := opt.Check(); err != nil {
+		return err
+	}
+	var (
+		policy   = opt.RestartPolicy
+		restarts []time.Time
+		attempt  int
+	)
+	for {
+		if onStart != nil {
+			onStart()
+		}
+		started := time.Now()
+		err := safeRunScanner(ctx, scanType, opt)
+		if ctx.Err() != nil || err == nil {
+			return nil
+		}
+		// a scanner that stayed up longer than the maximum backoff starts over from the initial one
+		if time.Since(started) > policy.MaxBackoff {
+			attempt = 0
+		}
+		attempt++
+
+		var allow bool
+		allow, restarts = policy.Allow(restarts, time.Now())
+		if !allow {
+			return fmt.Errorf("%s restarted %d times in %s, giving up: %w", opt.Chain, len(restarts), policy.Window, err)
+		}
+		restarts = append(restarts, time.Now())
+
+		wait := policy.Backoff(attempt)
+		log.Error("run %s WipeBlock error: %v. restarting in %s...", opt.Chain, err, wait)
+		metrics.NewMetrics().ScanRestartTotal(opt.Chain)
+		if opt.OnRestart != nil {
+			opt.OnRestart(err, attempt)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+	}
+}
+
+func runScanner(ctx context.Context, scanType ScanType, opt services.ScanEventsOptions) error {
+	instance, err := newScanInstance(scanType)
+	if err != nil {
+		return err
 	}
 	instance.SetMetrics(metrics.NewMetrics())
 	if err := opt.Check(); err != nil {
@@ -37,17 +149,22 @@ func StartScanChainEvents(ctx context.Context, scanType ScanType, opt services.S
 	if err := instance.Init(opt); err != nil {
 		return err
 	}
+	// stop anything the scanner left running once it returns
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	return instance.WipeBlock(ctx)
+}
 
-	if opt.RunForever {
-		defer func() {
-			if err := recover(); err != nil {
-				log.Error("run %s WipeBlock error: %v. restarting...", opt.Chain, err)
-				time.Sleep(time.Second * 1)
-				_ = StartScanChainEvents(ctx, scanType, opt)
+// safeRunScanner is runScanner with a panic in the scanner turned into an error.
+func safeRunScanner(ctx context.Context, scanType ScanType, opt services.ScanEventsOptions) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(error); ok {
+				err = e
+				return
 			}
-		}()
-		util.Panic(instance.WipeBlock(ctx))
-		return nil
-	}
-	return instance.WipeBlock(ctx)
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return runScanner(ctx, scanType, opt)
 }
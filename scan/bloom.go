@@ -0,0 +1,101 @@
+package scan
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/evolutionlandorg/block-scan/services"
+	"github.com/evolutionlandorg/block-scan/util/log"
+)
+
+// headerBatch is the number of block headers prefetched at once when the ChainIo has batch calls
+const headerBatch = 100
+
+// bloomFilter tests block logs blooms for the watched contracts and topics.
+type bloomFilter struct {
+	addresses [][]byte
+	topics    [][]byte
+}
+
+// newBloomFilter returns nil if there is nothing to test or an address is not an EVM address,
+// as a bloom cannot rule those blocks out.
+func newBloomFilter(chain string, contracts map[services.ContractsAddress]services.ContractsName, topics []string) *bloomFilter {
+	if len(contracts) == 0 {
+		return nil
+	}
+	f := new(bloomFilter)
+	for address := range contracts {
+		if !common.IsHexAddress(address.String()) {
+			log.Warn("%s bloom filter is disabled, %s is not an EVM address", chain, address)
+			return nil
+		}
+		f.addresses = append(f.addresses, common.HexToAddress(address.String()).Bytes())
+	}
+	for _, topic := range topics {
+		f.topics = append(f.topics, common.HexToHash(topic).Bytes())
+	}
+	return f
+}
+
+// mayContain reports whether a block with logs bloom bloom may have a log of a watched contract with
+// one of the watched topics. Blocks without a valid bloom may always match.
+func (f *bloomFilter) mayContain(bloom string) bool {
+	b, err := hexutil.Decode(bloom)
+	if err != nil || len(b) != types.BloomByteLength {
+		return true
+	}
+	bin := types.BytesToBloom(b)
+	return bloomTest(bin, f.addresses) && (len(f.topics) == 0 || bloomTest(bin, f.topics))
+}
+
+func bloomTest(bin types.Bloom, items [][]byte) bool {
+	for _, v := range items {
+		if bin.Test(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// header returns the header of blockNum. With a BatchChainIo the headers of the following blocks up to
+// head are fetched in the same batch and kept for the next calls.
+func (p *Polling) header(ctx context.Context, blockNum, head uint64) (*services.BlockHeader, error) {
+	if header, ok := p.headers[blockNum]; ok {
+		delete(p.headers, blockNum)
+		return header, nil
+	}
+	batch, ok := p.Opt.ChainIoV2.(services.BatchChainIo)
+	if !ok || head <= blockNum {
+		return p.Opt.ChainIoV2.BlockHeader(ctx, blockNum)
+	}
+	nums := []uint64{blockNum}
+	for i := blockNum + 1; i <= head && len(nums) < headerBatch; i++ {
+		nums = append(nums, i)
+	}
+	headers, err := batch.BlockHeaders(ctx, nums)
+	if err := services.BatchErr(err, 0); err != nil {
+		return nil, err
+	}
+	if headers[0] == nil {
+		return nil, fmt.Errorf("block header %d: %w", blockNum, services.ErrNotAvailable)
+	}
+	p.headers = make(map[uint64]*services.BlockHeader, len(nums)-1)
+	for i, num := range nums[1:] {
+		if headers[i+1] == nil || services.BatchErr(err, i+1) != nil {
+			break
+		}
+		p.headers[num] = headers[i+1]
+	}
+	return headers[0], nil
+}
+
+// filterTrans is ChainIoV2.FilterTrans, skipped for blocks whose header shows none of the watched logs.
+func (p *Polling) filterTrans(ctx context.Context, blockNum uint64, header *services.BlockHeader, filter []string) (*services.BlockTrans, error) {
+	if p.bloom != nil && header != nil && !p.bloom.mayContain(header.LogsBloom) {
+		return &services.BlockTrans{Timestamp: header.BlockTimeStamp}, nil
+	}
+	return p.Opt.ChainIoV2.FilterTrans(ctx, blockNum, filter)
+}
@@ -0,0 +1,129 @@
+package scan
+
+import (
+	"sync"
+	"time"
+)
+
+// Watermark tracks the transactions in flight for each block and commits the checkpoint
+// only up to the highest block below which every transaction has been delivered.
+// A committed checkpoint N means blocks up to and including N are done.
+// Progress through blocks without transactions is committed at most once per interval.
+type Watermark struct {
+	mu         sync.Mutex
+	commit     func(blockNum uint64)
+	interval   time.Duration
+	lastCommit time.Time
+	inflight   map[uint64]int
+	scanned    uint64
+	committed  uint64
+	// lastDone is the highest block a transaction was delivered from
+	lastDone uint64
+}
+
+func NewWatermark(commit func(blockNum uint64), interval time.Duration) *Watermark {
+	return &Watermark{commit: commit, interval: interval, lastCommit: time.Now(), inflight: make(map[uint64]int)}
+}
+
+// Reset moves the watermark to blockNum without committing it, for example after the
+// checkpoint was moved or rewound. Transactions still in flight keep being tracked.
+func (w *Watermark) Reset(blockNum uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.reset(blockNum)
+}
+
+// Rewind resets the watermark to ancestor after a reorg and forgets the transactions in flight
+// after it, they are not going to be delivered.
+func (w *Watermark) Rewind(ancestor uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for blockNum := range w.inflight {
+		if blockNum > ancestor {
+			delete(w.inflight, blockNum)
+		}
+	}
+	w.reset(ancestor)
+}
+
+func (w *Watermark) reset(blockNum uint64) {
+	w.scanned = blockNum
+	w.committed = blockNum
+	w.lastDone = blockNum
+}
+
+// Add records a transaction of blockNum that is about to be delivered.
+func (w *Watermark) Add(blockNum uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.inflight[blockNum]++
+}
+
+// Done records that a transaction added with Add has been delivered or given up on,
+// and commits the checkpoint if it can move forward.
+func (w *Watermark) Done(blockNum uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.inflight[blockNum]--; w.inflight[blockNum] <= 0 {
+		delete(w.inflight, blockNum)
+	}
+	if blockNum > w.lastDone {
+		w.lastDone = blockNum
+	}
+	w.advance()
+}
+
+// Drop forgets a transaction added with Add that this scanner will not deliver, without
+// moving the checkpoint. The checkpoint stays below its block until it is Reset.
+func (w *Watermark) Drop(blockNum uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.inflight[blockNum]--; w.inflight[blockNum] <= 0 {
+		delete(w.inflight, blockNum)
+	}
+	if blockNum <= w.scanned && blockNum > 0 {
+		w.scanned = blockNum - 1
+	}
+}
+
+// Scanned records that every transaction of the blocks up to blockNum has been added.
+func (w *Watermark) Scanned(blockNum uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if blockNum > w.scanned {
+		w.scanned = blockNum
+	}
+	// a delivered transaction may have finished before its block was fully scanned
+	if w.lastDone > w.committed || time.Since(w.lastCommit) >= w.interval {
+		w.advance()
+	}
+}
+
+// Committed returns the last committed checkpoint.
+func (w *Watermark) Committed() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.committed
+}
+
+func (w *Watermark) mark() uint64 {
+	mark := w.scanned
+	for blockNum := range w.inflight {
+		if blockNum == 0 {
+			// nothing is done while block 0 is in flight
+			return 0
+		}
+		if blockNum <= mark {
+			mark = blockNum - 1
+		}
+	}
+	return mark
+}
+
+func (w *Watermark) advance() {
+	if mark := w.mark(); mark > w.committed {
+		w.committed = mark
+		w.lastCommit = time.Now()
+		w.commit(mark)
+	}
+}
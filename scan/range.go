@@ -0,0 +1,91 @@
+package scan
+
+import (
+	"context"
+	"errors"
+
+	"github.com/evolutionlandorg/block-scan/services"
+	"github.com/evolutionlandorg/block-scan/util/log"
+)
+
+const (
+	// rangeBehind is how many blocks behind the head the scanner must be to filter ranges of blocks
+	rangeBehind = 100
+	// initialLogRange is the size of the first range, as in Subscribe.filterLogs
+	initialLogRange = 500
+	maxLogRange     = 5000
+)
+
+// rangeHead returns the last block range queries may cover at the given head. Range queries skip reorg
+// detection and the bloom filter, so they stop rangeBehind blocks, or the reorg window if it is larger,
+// before the head.
+func (p *Polling) rangeHead(head uint64) uint64 {
+	behind := uint64(p.Opt.ReorgWindow)
+	if behind < rangeBehind {
+		behind = rangeBehind
+	}
+	if head <= behind {
+		return 0
+	}
+	return head - behind
+}
+
+// scanRange filters the blocks from from up to rangeHead(head) with one range query and queues their
+// transactions. It returns the last block it covered, which is from-1 when nothing was covered. A range
+// the node rejects as too large is halved, and each successful range doubles the size again up to
+// maxLogRange. A single block with too many logs for a range query is filtered on its own.
+func (p *Polling) scanRange(ctx context.Context, ranger services.RangeChainIo, from, head uint64, filter []string) (uint64, error) {
+	to := from + p.logRange - 1
+	if limit := p.rangeHead(head); to > limit {
+		to = limit
+	}
+	blocks, err := ranger.FilterRange(ctx, from, to, filter)
+	if errors.Is(err, services.ErrTooManyResults) && p.logRange == 1 {
+		log.Debug("%s block %d has too many logs for a range query, filtering it alone", p.Opt.Chain, from)
+		var trans *services.BlockTrans
+		if trans, err = p.Opt.ChainIoV2.FilterTrans(ctx, from, filter); err == nil {
+			blocks = map[uint64]*services.BlockTrans{from: trans}
+		}
+	}
+	switch {
+	case errors.Is(err, services.ErrNotSupported):
+		log.Info("%s range queries are not supported, filtering block by block", p.Opt.Chain)
+		p.logRange = 0
+		return from - 1, nil
+	case errors.Is(err, services.ErrTooManyResults) && p.logRange > 1:
+		p.logRange /= 2
+		log.Debug("%s block %d-%d has too many logs, range shrinks to %d blocks", p.Opt.Chain, from, to, p.logRange)
+		return from - 1, nil
+	case err != nil:
+		return from - 1, err
+	}
+	for i := from; i <= to; i++ {
+		if trans := blocks[i]; trans != nil && len(trans.Txn) > 0 {
+			log.Debug("%s %d find tx id %v", p.Opt.Chain, i, trans.Txn)
+			if !p.enqueue(ctx, i, trans) {
+				return from - 1, ctx.Err()
+			}
+		}
+	}
+	p.checkpoint.Scanned(to)
+	p.Opt.Control.SetProgress(to)
+	log.Debug("scan %s block %d-%d", p.Opt.Chain, from, to)
+	if p.logRange *= 2; p.logRange > maxLogRange {
+		p.logRange = maxLogRange
+	}
+	return to, nil
+}
+
+// enqueue queues the transactions of a block for the receipt worker. It returns false once ctx is done.
+func (p *Polling) enqueue(ctx context.Context, blockNum uint64, trans *services.BlockTrans) bool {
+	generation := p.generations.current()
+	for index, txID := range trans.Txn {
+		p.checkpoint.Add(blockNum)
+		select {
+		case <-ctx.Done():
+			return false
+		case p.newTxn <- services.Tnx{Tx: txID, BlockTimestamp: trans.Timestamp, Contract: trans.Contracts[index], BlockNumber: blockNum, Generation: generation}:
+		}
+	}
+	return true
+}
@@ -0,0 +1,136 @@
+package scan
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/evolutionlandorg/block-scan/services"
+	"github.com/evolutionlandorg/block-scan/util/log"
+)
+
+type blockRecord struct {
+	num  uint64
+	hash string
+	txs  []string
+}
+
+// reorgWindow remembers the hashes and delivered transactions of the most recent scanned blocks.
+type reorgWindow struct {
+	size   int
+	blocks []blockRecord
+}
+
+func newReorgWindow(size int) *reorgWindow {
+	return &reorgWindow{size: size}
+}
+
+func (w *reorgWindow) add(num uint64, hash string, txs []string) {
+	if last, ok := w.last(); ok && last.num+1 != num {
+		// not contiguous with what we have, e.g. the checkpoint was moved
+		w.blocks = nil
+	}
+	w.blocks = append(w.blocks, blockRecord{num: num, hash: hash, txs: txs})
+	if len(w.blocks) > w.size {
+		w.blocks = w.blocks[len(w.blocks)-w.size:]
+	}
+}
+
+func (w *reorgWindow) last() (blockRecord, bool) {
+	if len(w.blocks) == 0 {
+		return blockRecord{}, false
+	}
+	return w.blocks[len(w.blocks)-1], true
+}
+
+// rewind drops every block after ancestor and returns their transactions.
+func (w *reorgWindow) rewind(ancestor uint64) []string {
+	var orphaned []string
+	for i, b := range w.blocks {
+		if b.num > ancestor {
+			for _, v := range w.blocks[i:] {
+				orphaned = append(orphaned, v.txs...)
+			}
+			w.blocks = w.blocks[:i]
+			break
+		}
+	}
+	return orphaned
+}
+
+// generations numbers the reorg rewinds of the scanner. Transactions are queued with the generation
+// they were found in, and a later rewind to an ancestor before their block orphans them. Deliveries
+// hold mu for reading, so a rewind waits for the ones in progress.
+type generations struct {
+	mu sync.RWMutex
+	// ancestors are the common ancestors of the rewinds, ancestors[g] ended generation g
+	ancestors []uint64
+}
+
+// current returns the generation of newly found transactions.
+func (g *generations) current() uint64 {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return uint64(len(g.ancestors))
+}
+
+// orphaned reports whether a rewind since txn was found replaced its block. g.mu must be held.
+func (g *generations) orphaned(txn services.Tnx) bool {
+	if txn.SkipCheckpoint || txn.Generation >= uint64(len(g.ancestors)) {
+		return false
+	}
+	for _, ancestor := range g.ancestors[txn.Generation:] {
+		if txn.BlockNumber > ancestor {
+			return true
+		}
+	}
+	return false
+}
+
+// checkReorg compares the parent hash of the header of blockNum with the recorded hash of the block
+// before it. On a mismatch it rewinds the checkpoint to the common ancestor, drops the transactions of
+// the replaced blocks that are still queued or retrying, calls OnReorg and returns the ancestor with
+// reorged set. Headers without a parent hash are not checked.
+func (p *Polling) checkReorg(ctx context.Context, blockNum uint64, header *services.BlockHeader) (ancestor uint64, reorged bool, err error) {
+	if p.reorg == nil || header == nil {
+		return 0, false, nil
+	}
+	prev, ok := p.reorg.last()
+	if !ok || prev.num+1 != blockNum || header.ParentHash == "" || strings.EqualFold(header.ParentHash, prev.hash) {
+		return 0, false, nil
+	}
+
+	ancestor = p.reorg.blocks[0].num - 1
+	for i := len(p.reorg.blocks) - 1; i >= 0; i-- {
+		b := p.reorg.blocks[i]
+		h, err := p.Opt.ChainIoV2.BlockHeader(ctx, b.num)
+		if err != nil {
+			return 0, false, err
+		}
+		if strings.EqualFold(h.Hash, b.hash) {
+			ancestor = b.num
+			break
+		}
+	}
+	if ancestor < p.reorg.blocks[0].num {
+		log.Error("%s reorg at block %d is deeper than the %d blocks window", p.Opt.Chain, blockNum, p.reorg.size)
+	}
+	orphaned := p.reorg.rewind(ancestor)
+	p.headers = nil
+	log.Warn("%s chain reorganization detected at block %d, rewinding to %d. orphaned tx %v", p.Opt.Chain, blockNum, ancestor, orphaned)
+	p.generations.mu.Lock()
+	p.generations.ancestors = append(p.generations.ancestors, ancestor)
+	p.checkpoint.Rewind(ancestor)
+	p.generations.mu.Unlock()
+	p.Opt.RewindStartBlock(ancestor)
+	p.Opt.OnReorg(ancestor+1, blockNum-1, orphaned)
+	return ancestor, true, nil
+}
+
+// recordBlock adds a scanned block to the reorg window.
+func (p *Polling) recordBlock(blockNum uint64, header *services.BlockHeader, txs []string) {
+	if p.reorg == nil || header == nil {
+		return
+	}
+	p.reorg.add(blockNum, header.Hash, txs)
+}
@@ -2,6 +2,7 @@ package scan
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/evolutionlandorg/block-scan/metrics"
 	"strings"
@@ -10,16 +11,28 @@ import (
 	"github.com/evolutionlandorg/block-scan/services"
 	"github.com/evolutionlandorg/block-scan/util"
 	"github.com/evolutionlandorg/block-scan/util/log"
-	"github.com/spf13/cast"
 )
 
-var (
-	newTxn = make(chan services.Tnx, 1000)
-)
+// receiptBatch is the most queued transactions whose receipts are fetched together from a services.BatchChainIo
+const receiptBatch = 100
 
 type Polling struct {
 	Opt     services.ScanEventsOptions
 	metrics metrics.Metrics
+	newTxn  chan services.Tnx
+	reorg   *reorgWindow
+	// checkpoint commits SetStartBlock over fully delivered blocks
+	checkpoint *Watermark
+	// logRange is the number of blocks in the next range query, 0 once they are not supported
+	logRange uint64
+	bloom    *bloomFilter
+	// headers are the prefetched block headers by number
+	headers     map[uint64]*services.BlockHeader
+	generations generations
+
+	// Delivered, if set, reports transactions that were already delivered. They are skipped while
+	// following the chain, but rescans and dead-letter replays deliver them again
+	Delivered func(tx string) bool
 }
 
 func (p *Polling) SetMetrics(metrics metrics.Metrics) {
@@ -38,7 +51,17 @@ func (p *Polling) RunBeforePushMiddleware(tx string, BlockTimestamp uint64, rece
 	return true
 }
 
-func (p *Polling) ReceiptDistribution(tx string, BlockTimestamp uint64, receipt *services.Receipts) error {
+func (p *Polling) RunAfterPushMiddleware(tx string, BlockTimestamp uint64, receipt *services.Receipts) {
+	for _, v := range p.Opt.AfterPushMiddleware {
+		if v != nil {
+			v(tx, BlockTimestamp, receipt)
+		}
+	}
+}
+
+// ReceiptDistribution sends the receipt to the Sink once for each watched contract in its logs.
+// It stops at the first Sink error and returns it.
+func (p *Polling) ReceiptDistribution(ctx context.Context, tx string, BlockTimestamp uint64, receipt *services.Receipts) error {
 	var logs []services.Log
 	var exist = make(map[string]struct{})
 
@@ -60,10 +83,12 @@ func (p *Polling) ReceiptDistribution(tx string, BlockTimestamp uint64, receipt
 		Txid:           tx,
 		Receipts:       receipt,
 		BlockTimestamp: BlockTimestamp,
-		Callback:       p.Opt.GetCallbackFunc(tx, BlockTimestamp, receipt),
+	}
+	if p.Opt.GetCallbackFunc != nil {
+		fb.Callback = p.Opt.GetCallbackFunc(tx, BlockTimestamp, receipt)
 	}
 
-	for _, l := range receipt.Logs {
+	for index, l := range receipt.Logs {
 		eventAddress := strings.ToLower(l.Address)
 		if _, ok := exist[eventAddress]; ok {
 			continue
@@ -73,9 +98,15 @@ func (p *Polling) ReceiptDistribution(tx string, BlockTimestamp uint64, receipt
 			contractName := strings.ToLower(p.Opt.ContractsName[services.ContractsAddress(eventAddress)].String())
 			for _, v := range p.Opt.CallbackMethodPrefix {
 				if strings.EqualFold(v, contractName) {
-					fb.ContractName = v
+					// a copy for each contract, the Sink may keep it
+					event := fb
+					event.ContractName = v
+					event.Position = index
+					event.LogIndex = l.BlockIndex(index)
 					p.metrics.ScanCallbackTotal(v)
-					_ = fb.Do()
+					if err := p.Opt.Sink.Send(ctx, &event); err != nil {
+						return fmt.Errorf("%s send %s %s: %w", p.Opt.Chain, tx, v, err)
+					}
 					break
 				}
 			}
@@ -85,31 +116,363 @@ func (p *Polling) ReceiptDistribution(tx string, BlockTimestamp uint64, receipt
 }
 
 func (p *Polling) Init(opt services.ScanEventsOptions) error {
+	if err := opt.Check(); err != nil {
+		return err
+	}
 	p.Opt = opt
-	return opt.Check()
+	p.newTxn = make(chan services.Tnx, opt.TxQueueSize)
+	p.checkpoint = NewWatermark(opt.SetStartBlock, opt.CheckpointInterval)
+	p.logRange = initialLogRange
+	if opt.BloomFilter {
+		p.bloom = newBloomFilter(opt.Chain, opt.ContractsName, opt.Topics)
+	}
+	if opt.OnReorg != nil {
+		p.reorg = newReorgWindow(opt.ReorgWindow)
+	}
+	return nil
+}
+
+// FetchReceipt returns the receipt of txn. It returns an error wrapping services.ErrNotAvailable if the
+// receipt is not available yet; a nil receipt and nil error means the transaction failed and has nothing to deliver.
+func (p *Polling) FetchReceipt(ctx context.Context, txn services.Tnx) (*services.Receipts, error) {
+	// check Transaction fail
+	status, err := p.Opt.ChainIoV2.GetTransactionStatus(ctx, txn.Tx)
+	if err != nil {
+		return nil, err
+	}
+	if status == services.TxStatusFail {
+		return nil, nil
+	}
+	receipt, err := p.Opt.ChainIoV2.ReceiptLog(ctx, txn.Tx)
+	if err != nil {
+		return nil, err
+	}
+	// maybe confirmed delay
+	if receipt == nil || len(receipt.Logs) == 0 {
+		return nil, fmt.Errorf("receipt of %s: %w", txn.Tx, services.ErrNotAvailable)
+	}
+	return receipt, nil
+}
+
+// FetchReceipts fetches the receipts of txns in one batch when the ChainIoV2 implements services.BatchChainIo,
+// otherwise one by one with FetchReceipt. The results line up with txns and follow the rules of FetchReceipt.
+func (p *Polling) FetchReceipts(ctx context.Context, txns []services.Tnx) ([]*services.Receipts, []error) {
+	receipts := make([]*services.Receipts, len(txns))
+	errs := make([]error, len(txns))
+	batch, ok := p.Opt.ChainIoV2.(services.BatchChainIo)
+	if !ok || len(txns) == 1 {
+		for i, txn := range txns {
+			receipts[i], errs[i] = p.FetchReceipt(ctx, txn)
+		}
+		return receipts, errs
+	}
+	txs := make([]string, len(txns))
+	for i, txn := range txns {
+		txs[i] = txn.Tx
+	}
+	got, err := batch.ReceiptLogs(ctx, txs)
+	for i, txn := range txns {
+		if errs[i] = services.BatchErr(err, i); errs[i] != nil {
+			continue
+		}
+		switch receipt := got[i]; {
+		case receipt != nil && receipt.Status == "0x0":
+		case receipt == nil || len(receipt.Logs) == 0:
+			errs[i] = fmt.Errorf("receipt of %s: %w", txn.Tx, services.ErrNotAvailable)
+		default:
+			receipts[i] = receipt
+		}
+	}
+	return receipts, errs
+}
+
+// Deliver passes the receipt of txn through Delivered and the BeforePushMiddleware, distributes it and
+// runs the AfterPushMiddleware once it was sent. It does not move the checkpoint.
+func (p *Polling) Deliver(ctx context.Context, txn services.Tnx, receipt *services.Receipts) error {
+	p.metrics.ScanTxTotal(p.Opt.Chain)
+	if !txn.SkipCheckpoint && p.Delivered != nil && p.Delivered(txn.Tx) {
+		return nil
+	}
+	if !p.RunBeforePushMiddleware(txn.Tx, txn.BlockTimestamp, receipt) {
+		return nil
+	}
+	if err := p.ReceiptDistribution(ctx, txn.Tx, txn.BlockTimestamp, receipt); err != nil {
+		return err
+	}
+	p.RunAfterPushMiddleware(txn.Tx, txn.BlockTimestamp, receipt)
+	return nil
+}
+
+// Checkpoint returns the watermark that commits this scanner's checkpoint.
+func (p *Polling) Checkpoint() *Watermark {
+	return p.checkpoint
+}
+
+// processTx delivers one transaction. It returns the error of fetching the receipt.
+func (p *Polling) processTx(ctx context.Context, txn services.Tnx) error {
+	receipt, err := p.FetchReceipt(ctx, txn)
+	return p.finishTx(ctx, txn, receipt, err)
+}
+
+// sinkError is an error of the Sink, as opposed to one of fetching the receipt.
+type sinkError struct {
+	err error
+}
+
+func (e *sinkError) Error() string { return e.err.Error() }
+func (e *sinkError) Unwrap() error { return e.err }
+
+// finishTx delivers a fetched receipt and marks its transaction done. The transaction is not done
+// if err is set or the Sink fails. A transaction orphaned by a reorg is dropped.
+func (p *Polling) finishTx(ctx context.Context, txn services.Tnx, receipt *services.Receipts, err error) error {
+	if err != nil {
+		return err
+	}
+	p.generations.mu.RLock()
+	defer p.generations.mu.RUnlock()
+	if p.generations.orphaned(txn) {
+		log.Debug("%s %s was orphaned by a reorg, dropping it", p.Opt.Chain, txn.Tx)
+		return nil
+	}
+	if receipt != nil {
+		if err := p.Deliver(ctx, txn, receipt); err != nil {
+			return &sinkError{err: err}
+		}
+	}
+	if !txn.SkipCheckpoint {
+		p.checkpoint.Done(txn.BlockNumber)
+	}
+	return nil
+}
+
+// retryTx queues txn again after a backoff, or moves it to the dead-letter store once err is permanent
+// or fetching the receipt is out of attempts. A failing Sink is retried until it accepts the events, so
+// the checkpoint stays below them. A transaction the dead-letter store fails to keep is retried as well.
+// A transaction orphaned by a reorg is dropped.
+func (p *Polling) retryTx(ctx context.Context, txn services.Tnx, err error) {
+	txn.Attempts++
+	p.generations.mu.RLock()
+	defer p.generations.mu.RUnlock()
+	if p.generations.orphaned(txn) {
+		log.Debug("%s %s was orphaned by a reorg, dropping it", p.Opt.Chain, txn.Tx)
+		return
+	}
+	var sinkErr *sinkError
+	outOfAttempts := txn.Attempts >= p.Opt.MaxTxAttempts && !errors.As(err, &sinkErr)
+	if (outOfAttempts || services.IsPermanent(err)) && p.deadLetter(txn, err) {
+		// dead letters are replayed on request, they do not hold the checkpoint back
+		if !txn.SkipCheckpoint {
+			p.checkpoint.Done(txn.BlockNumber)
+		}
+		return
+	}
+	time.AfterFunc(p.Opt.TxRetryDelay(txn.Attempts), func() {
+		select {
+		case <-ctx.Done():
+		case p.newTxn <- txn:
+		}
+	})
+}
+
+// deadLetter reports whether txn was put in the dead-letter store.
+func (p *Polling) deadLetter(txn services.Tnx, reason error) bool {
+	log.Error("%s %s failed after %d attempts: %v. moving it to dead letters", p.Opt.Chain, txn.Tx, txn.Attempts, reason)
+	if err := p.Opt.DeadLetterStore.Put(services.DeadLetter{
+		Tnx:         txn,
+		Chain:       p.Opt.Chain,
+		Reason:      reason.Error(),
+		LastAttempt: time.Now(),
+	}); err != nil {
+		log.Error("%s put %s to dead letters error: %v. trying it again", p.Opt.Chain, txn.Tx, err)
+		return false
+	}
+	return true
+}
+
+// ReplayDeadLetters retries every dead-lettered transaction of the chain once. Delivered ones are removed
+// from the dead-letter store, the others stay there with their attempts counted. It returns how many were delivered.
+func (p *Polling) ReplayDeadLetters(ctx context.Context) (int, error) {
+	letters, err := p.Opt.DeadLetterStore.List(p.Opt.Chain)
+	if err != nil {
+		return 0, err
+	}
+	var replayed int
+	for _, letter := range letters {
+		if err := ctx.Err(); err != nil {
+			return replayed, err
+		}
+		letter.SkipCheckpoint = true
+		if err := p.processTx(ctx, letter.Tnx); err != nil {
+			if ctx.Err() != nil {
+				return replayed, ctx.Err()
+			}
+			letter.Attempts++
+			letter.Reason = err.Error()
+			letter.LastAttempt = time.Now()
+			if err := p.Opt.DeadLetterStore.Put(letter); err != nil {
+				return replayed, err
+			}
+			continue
+		}
+		if err := p.Opt.DeadLetterStore.Delete(p.Opt.Chain, letter.Tx); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+	return replayed, nil
+}
+
+// ScanBlocks delivers the events in [from, to] synchronously.
+// When rescan is set the checkpoint is not moved.
+func (p *Polling) ScanBlocks(ctx context.Context, from, to uint64, rescan bool) error {
+	filterContracts := p.filterContracts()
+	if rescan {
+		// headers prefetched off the scanning path could be stale once it gets there
+		defer func() { p.headers = nil }()
+	}
+	for i := from; i <= to; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var (
+			header *services.BlockHeader
+			err    error
+		)
+		if (!rescan && p.reorg != nil) || p.bloom != nil {
+			if header, err = p.header(ctx, i, to); err != nil {
+				return err
+			}
+		}
+		if !rescan {
+			if ancestor, reorged, err := p.checkReorg(ctx, i, header); err != nil {
+				return err
+			} else if reorged {
+				i = ancestor
+				continue
+			}
+		}
+		trans, err := p.filterTrans(ctx, i, header, filterContracts)
+		if err != nil {
+			return fmt.Errorf("%s filter block %d: %w", p.Opt.Chain, i, err)
+		}
+		if !rescan {
+			p.recordBlock(i, header, trans.Txn)
+		}
+		txns := make([]services.Tnx, len(trans.Txn))
+		generation := p.generations.current()
+		for index, txID := range trans.Txn {
+			txns[index] = services.Tnx{Tx: txID, BlockTimestamp: trans.Timestamp, Contract: trans.Contracts[index], BlockNumber: i, SkipCheckpoint: rescan, Generation: generation}
+			if !rescan {
+				p.checkpoint.Add(i)
+			}
+		}
+		receipts, errs := p.FetchReceipts(ctx, txns)
+		for index, txn := range txns {
+			if errs[index] == nil && p.finishTx(ctx, txn, receipts[index], nil) == nil {
+				continue
+			}
+			if err := p.Retry(ctx, func() error { return p.processTx(ctx, txn) }); err != nil {
+				if !rescan {
+					for range txns[index:] {
+						p.checkpoint.Drop(i)
+					}
+				}
+				return fmt.Errorf("%s block %d tx %s: %w", p.Opt.Chain, i, txn.Tx, err)
+			}
+		}
+		if !rescan {
+			p.checkpoint.Scanned(i)
+		}
+	}
+	return nil
+}
+
+// HandleControl blocks while the scanner is paused and runs any pending rescans and dead-letter replays.
+// It returns an error once ctx is done.
+func (p *Polling) HandleControl(ctx context.Context) error {
+	if err := p.Opt.Control.Wait(ctx); err != nil {
+		return err
+	}
+	// rescans and replays must not hold back following the chain head
+	lowCtx := services.WithPriority(ctx, services.PriorityBackfill)
+	for _, r := range p.Opt.Control.TakeRescans() {
+		log.Info("%s rescan block %d-%d", p.Opt.Chain, r.From, r.To)
+		if err := p.ScanBlocks(lowCtx, r.From, r.To, true); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			log.Error("%s rescan block %d-%d error: %v", p.Opt.Chain, r.From, r.To, err)
+		}
+	}
+	if p.Opt.Control.TakeReplay() {
+		replayed, err := p.ReplayDeadLetters(lowCtx)
+		if err != nil && ctx.Err() != nil {
+			return err
+		}
+		log.Info("%s replayed %d dead letters, error: %v", p.Opt.Chain, replayed, err)
+	}
+	return nil
+}
+
+// Retry calls f up to 10 times, one second apart, while it returns a retryable error.
+func (p *Polling) Retry(ctx context.Context, f func() error) error {
+	var err error
+	for try := 0; try < 10; try++ {
+		if err = f(); !services.IsRetryable(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+	return err
+}
+
+func (p *Polling) filterContracts() []string {
+	var filterContracts []string
+	for k := range p.Opt.ContractsName {
+		filterContracts = append(filterContracts, k.String())
+	}
+	return filterContracts
 }
 
 func (p *Polling) WipeBlock(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	defer func() {
+		cancel()
+		<-done
+	}()
 	go func() {
+		defer close(done)
 		for {
 			select {
 			case <-ctx.Done():
 				return
-			case txn := <-newTxn:
-				// check Transaction fail
-				if status := p.Opt.ChainIo.GetTransactionStatus(txn.Tx); status == "Fail" {
-					continue
-				}
-				receipt, _ := p.Opt.ChainIo.ReceiptLog(txn.Tx)
-				// maybe network abnormal or confirmed delay
-				if receipt == nil || len(receipt.Logs) == 0 {
-					newTxn <- txn
-					continue
+			case txn := <-p.newTxn:
+				txns := []services.Tnx{txn}
+				if _, ok := p.Opt.ChainIoV2.(services.BatchChainIo); ok {
+					// take what is already queued so it is fetched in one batch
+				queued:
+					for len(txns) < receiptBatch {
+						select {
+						case txn := <-p.newTxn:
+							txns = append(txns, txn)
+						default:
+							break queued
+						}
+					}
 				}
-				p.metrics.ScanTxTotal(p.Opt.Chain)
-				if p.RunBeforePushMiddleware(txn.Tx, txn.BlockTimestamp, receipt) {
-					_ = p.ReceiptDistribution(txn.Tx, txn.BlockTimestamp, receipt)
-					p.Opt.SetStartBlock(cast.ToUint64(receipt.BlockNumber))
+				receipts, errs := p.FetchReceipts(ctx, txns)
+				for i, txn := range txns {
+					if err := p.finishTx(ctx, txn, receipts[i], errs[i]); err != nil {
+						if ctx.Err() != nil {
+							return
+						}
+						p.retryTx(ctx, txn, err)
+					}
 				}
 			}
 		}
@@ -117,47 +480,144 @@ func (p *Polling) WipeBlock(ctx context.Context) error {
 	log.Debug("start %s wipeBlock", p.Opt.Chain)
 	var (
 		currentBlockNum uint64
-		filterContracts []string
+		filterContracts = p.filterContracts()
 	)
-	for k := range p.Opt.ContractsName {
-		filterContracts = append(filterContracts, k.String())
-	}
+	ranger, _ := p.Opt.ChainIoV2.(services.RangeChainIo)
 	sleepTime := util.GetSleepTime()
 	for {
-		select {
-		case <-ctx.Done():
+		if err := p.HandleControl(ctx); err != nil {
 			return nil
-		default:
 		}
 
-		chainCurrentBlockNum := p.Opt.ChainIo.BlockNumber()
+		head, err := p.Opt.ChainIoV2.BlockNumber(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if !services.IsRetryable(err) {
+				return err
+			}
+			log.Warn("%s get block number error: %v", p.Opt.Chain, err)
+		}
+		chainCurrentBlockNum := p.Opt.ConfirmedHead(head)
 		if chainCurrentBlockNum == 0 {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(sleepTime):
+			}
 			continue
 		}
 		if currentBlockNum <= 0 {
-			currentBlockNum = p.Opt.GetStartBlock()
-		}
-		if currentBlockNum <= 0 {
-			currentBlockNum = p.Opt.InitBlock
+			if currentBlockNum, err = p.Opt.StartBlock(ctx); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+			if currentBlockNum <= 0 {
+				currentBlockNum = p.Opt.InitBlock
+			}
+			p.checkpoint.Reset(currentBlockNum)
 		}
 
-		if currentBlockNum < chainCurrentBlockNum {
-			for i := currentBlockNum + 1; i <= chainCurrentBlockNum; i++ {
-				txIDs, contracts, blockTimeStamp, transactionTo := p.Opt.ChainIo.FilterTrans(uint64(i), filterContracts)
-				if i%100 == 0 && len(txIDs) == 0 {
-					log.Debug("scan %s current block %d", p.Opt.Chain, i)
-					continue
+		for currentBlockNum < chainCurrentBlockNum {
+			if err := p.HandleControl(ctx); err != nil {
+				return nil
+			}
+			if blockNum, ok := p.Opt.Control.TakeCheckpoint(); ok {
+				log.Info("%s checkpoint moved to %d", p.Opt.Chain, blockNum)
+				currentBlockNum = blockNum
+				p.checkpoint.Reset(blockNum)
+				p.headers = nil
+				continue
+			}
+			if ranger != nil && p.logRange > 0 && currentBlockNum < p.rangeHead(chainCurrentBlockNum) {
+				to, err := p.scanRange(ctx, ranger, currentBlockNum+1, chainCurrentBlockNum, filterContracts)
+				if err != nil {
+					if ctx.Err() != nil {
+						return nil
+					}
+					if !services.IsRetryable(err) {
+						return err
+					}
+					log.Warn("%s filter block %d-%d error: %v", p.Opt.Chain, currentBlockNum+1, chainCurrentBlockNum, err)
+					break
 				}
-				if len(txIDs) == 0 {
-					continue
+				currentBlockNum = to
+				continue
+			}
+			i := currentBlockNum + 1
+			var header *services.BlockHeader
+			if p.reorg != nil || p.bloom != nil {
+				if header, err = p.header(ctx, i, chainCurrentBlockNum); err != nil {
+					if ctx.Err() != nil {
+						return nil
+					}
+					if !services.IsRetryable(err) {
+						return fmt.Errorf("%s block header %d: %w", p.Opt.Chain, i, err)
+					}
+					log.Warn("%s get block header %d error: %v", p.Opt.Chain, i, err)
+					break
+				}
+			}
+			ancestor, reorged, err := p.checkReorg(ctx, i, header)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				if !services.IsRetryable(err) {
+					return err
 				}
-				log.Debug("%s %d find tx id %v; transaction contracts %v", p.Opt.Chain, i, txIDs, transactionTo)
-				for index, txID := range txIDs {
-					newTxn <- services.Tnx{Tx: txID, BlockTimestamp: blockTimeStamp, Contract: contracts[index]}
+				log.Warn("%s check reorg error: %v", p.Opt.Chain, err)
+				break
+			}
+			if reorged {
+				currentBlockNum = ancestor
+				continue
+			}
+			trans, err := p.filterTrans(ctx, i, header, filterContracts)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				if !services.IsRetryable(err) {
+					return fmt.Errorf("%s filter block %d: %w", p.Opt.Chain, i, err)
 				}
+				log.Warn("%s filter block %d error: %v", p.Opt.Chain, i, err)
+				break
 			}
-			currentBlockNum = chainCurrentBlockNum
+			currentBlockNum = i
+			p.Opt.Control.SetProgress(i)
+			txIDs, transactionTo := trans.Txn, trans.TransactionTo
+			p.recordBlock(i, header, txIDs)
+			if len(txIDs) == 0 {
+				p.checkpoint.Scanned(i)
+				if i%100 == 0 {
+					log.Debug("scan %s current block %d", p.Opt.Chain, i)
+				}
+				continue
+			}
+			log.Debug("%s %d find tx id %v; transaction contracts %v", p.Opt.Chain, i, txIDs, transactionTo)
+			if !p.enqueue(ctx, i, trans) {
+				return nil
+			}
+			p.checkpoint.Scanned(i)
+		}
+		if blockNum, ok := p.Opt.Control.TakeCheckpoint(); ok {
+			log.Info("%s checkpoint moved to %d", p.Opt.Chain, blockNum)
+			currentBlockNum = blockNum
+			p.checkpoint.Reset(blockNum)
+			p.headers = nil
+			continue
+		}
+		if currentBlockNum >= chainCurrentBlockNum {
+			p.Opt.CaughtUp(currentBlockNum)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(sleepTime):
 		}
-		time.Sleep(sleepTime)
 	}
 }
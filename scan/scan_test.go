@@ -0,0 +1,888 @@
+package scan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/evolutionlandorg/block-scan/metrics"
+	"github.com/evolutionlandorg/block-scan/services"
+	"github.com/stretchr/testify/assert"
+)
+
+type chainIo struct {
+	chain string
+	t     *testing.T
+}
+
+func (c *chainIo) ReceiptLog(tx string) (*services.Receipts, error) {
+	assert.True(c.t, strings.HasPrefix(tx, c.chain), "%s received %s", c.chain, tx)
+	var blockNum uint64
+	_, _ = fmt.Sscanf(strings.TrimPrefix(tx, c.chain), "-%d", &blockNum)
+	return &services.Receipts{
+		BlockNumber: fmt.Sprint(blockNum),
+		Logs:        []services.Log{{Topics: []string{"0x1"}, Data: tx, Address: "0x222"}},
+		Status:      "0x1",
+		ChainSource: c.chain,
+	}, nil
+}
+
+func (c *chainIo) BlockNumber() uint64 {
+	return 20
+}
+
+func (c *chainIo) FilterTrans(blockNum uint64, _ []string) ([]string, []string, uint64, []string) {
+	return []string{fmt.Sprintf("%s-%d", c.chain, blockNum)}, []string{"0x222"}, blockNum, []string{"0x222"}
+}
+
+func (c *chainIo) BlockHeader(blockNum uint64) *services.BlockHeader {
+	return &services.BlockHeader{BlockTimeStamp: blockNum}
+}
+
+func (c *chainIo) GetTransactionStatus(_ string) string {
+	return "0x1"
+}
+
+func TestPollingInstancesDoNotShareTransactions(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		delivered = make(map[string][]string)
+		wg        sync.WaitGroup
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, chain := range []string{"Crab", "Heco"} {
+		chain := chain
+		p := new(Polling)
+		p.SetMetrics(metrics.NewMetrics())
+		assert.NoError(t, p.Init(services.ScanEventsOptions{
+			ChainIo:       &chainIo{chain: chain, t: t},
+			Chain:         chain,
+			GetStartBlock: func() uint64 { return 0 },
+			SetStartBlock: func(uint64) {},
+			ContractsName: map[services.ContractsAddress]services.ContractsName{"0x222": "fake"},
+			GetCallbackFunc: func(tx string, _ uint64, _ *services.Receipts) interface{} {
+				mu.Lock()
+				defer mu.Unlock()
+				delivered[chain] = append(delivered[chain], tx)
+				return nil
+			},
+			InitBlock:   10,
+			TxQueueSize: 2,
+		}))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, p.WipeBlock(ctx))
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(t, delivered["Crab"], 10)
+	assert.Len(t, delivered["Heco"], 10)
+}
+
+func TestPollingConfirmations(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		delivered []string
+	)
+	p := new(Polling)
+	p.SetMetrics(metrics.NewMetrics())
+	assert.NoError(t, p.Init(services.ScanEventsOptions{
+		ChainIo:       &chainIo{chain: "Crab", t: t},
+		Chain:         "Crab",
+		GetStartBlock: func() uint64 { return 0 },
+		SetStartBlock: func(uint64) {},
+		ContractsName: map[services.ContractsAddress]services.ContractsName{"0x222": "fake"},
+		GetCallbackFunc: func(tx string, _ uint64, _ *services.Receipts) interface{} {
+			mu.Lock()
+			defer mu.Unlock()
+			delivered = append(delivered, tx)
+			return nil
+		},
+		InitBlock:     10,
+		Confirmations: 5,
+	}))
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	assert.NoError(t, p.WipeBlock(ctx))
+
+	// the head is 20, so block 15 is the newest one with 5 confirmations
+	assert.ElementsMatch(t, []string{"Crab-11", "Crab-12", "Crab-13", "Crab-14", "Crab-15"}, delivered)
+}
+
+type reorgChainIo struct {
+	chainIo
+	forked int32
+}
+
+func (c *reorgChainIo) hash(blockNum uint64) string {
+	if atomic.LoadInt32(&c.forked) == 1 && blockNum >= 18 {
+		return fmt.Sprintf("b-%d", blockNum)
+	}
+	return fmt.Sprintf("a-%d", blockNum)
+}
+
+func (c *reorgChainIo) BlockNumber() uint64 {
+	if atomic.LoadInt32(&c.forked) == 1 {
+		return 21
+	}
+	return 20
+}
+
+func (c *reorgChainIo) BlockHeader(blockNum uint64) *services.BlockHeader {
+	return &services.BlockHeader{BlockTimeStamp: blockNum, Hash: c.hash(blockNum), ParentHash: c.hash(blockNum - 1)}
+}
+
+func TestPollingReorg(t *testing.T) {
+	type reorg struct {
+		from, to uint64
+		orphaned []string
+	}
+	var (
+		mu         sync.Mutex
+		reorgs     []reorg
+		checkpoint uint64
+	)
+	c := &reorgChainIo{chainIo: chainIo{chain: "Crab", t: t}}
+	p := new(Polling)
+	p.SetMetrics(metrics.NewMetrics())
+	assert.NoError(t, p.Init(services.ScanEventsOptions{
+		ChainIo:       c,
+		Chain:         "Crab",
+		GetStartBlock: func() uint64 { return 0 },
+		SetStartBlock: func(blockNum uint64) {
+			mu.Lock()
+			defer mu.Unlock()
+			checkpoint = blockNum
+		},
+		ContractsName: map[services.ContractsAddress]services.ContractsName{"0x222": "fake"},
+		GetCallbackFunc: func(string, uint64, *services.Receipts) interface{} {
+			return nil
+		},
+		InitBlock: 10,
+		OnCaughtUp: func(uint64) {
+			atomic.StoreInt32(&c.forked, 1)
+		},
+		OnReorg: func(fromBlock, toBlock uint64, orphanedTxs []string) {
+			mu.Lock()
+			defer mu.Unlock()
+			reorgs = append(reorgs, reorg{from: fromBlock, to: toBlock, orphaned: orphanedTxs})
+		},
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = p.WipeBlock(ctx)
+	}()
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(reorgs) == 1 && checkpoint == 21
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, reorg{from: 18, to: 20, orphaned: []string{"Crab-18", "Crab-19", "Crab-20"}}, reorgs[0])
+}
+
+// orphanChainIo has the reorg of reorgChainIo with other transactions in the new blocks. The receipt
+// of Crab-19 is not available until the reorg.
+type orphanChainIo struct {
+	reorgChainIo
+	rewound int32
+	fetched int32
+}
+
+func (c *orphanChainIo) FilterTrans(blockNum uint64, filter []string) ([]string, []string, uint64, []string) {
+	txn, contracts, timestamp, transactionTo := c.chainIo.FilterTrans(blockNum, filter)
+	if atomic.LoadInt32(&c.forked) == 1 && blockNum >= 18 {
+		txn = []string{fmt.Sprintf("Crab-%d-b", blockNum)}
+	}
+	return txn, contracts, timestamp, transactionTo
+}
+
+func (c *orphanChainIo) ReceiptLog(tx string) (*services.Receipts, error) {
+	if tx == "Crab-19" {
+		if atomic.LoadInt32(&c.rewound) == 0 {
+			return nil, nil
+		}
+		atomic.AddInt32(&c.fetched, 1)
+	}
+	return c.chainIo.ReceiptLog(tx)
+}
+
+func TestPollingReorgDropsOrphanedTxs(t *testing.T) {
+	var (
+		mu         sync.Mutex
+		delivered  []string
+		checkpoint uint64
+	)
+	c := &orphanChainIo{reorgChainIo: reorgChainIo{chainIo: chainIo{chain: "Crab", t: t}}}
+	p := new(Polling)
+	p.SetMetrics(metrics.NewMetrics())
+	assert.NoError(t, p.Init(services.ScanEventsOptions{
+		ChainIo:       c,
+		Chain:         "Crab",
+		GetStartBlock: func() uint64 { return 0 },
+		SetStartBlock: func(blockNum uint64) { atomic.StoreUint64(&checkpoint, blockNum) },
+		ContractsName: map[services.ContractsAddress]services.ContractsName{"0x222": "fake"},
+		GetCallbackFunc: func(tx string, _ uint64, _ *services.Receipts) interface{} {
+			mu.Lock()
+			defer mu.Unlock()
+			delivered = append(delivered, tx)
+			return nil
+		},
+		InitBlock: 15,
+		OnCaughtUp: func(uint64) {
+			atomic.StoreInt32(&c.forked, 1)
+		},
+		OnReorg: func(uint64, uint64, []string) {
+			atomic.StoreInt32(&c.rewound, 1)
+		},
+		CheckpointInterval: time.Millisecond,
+		TxRetryBackoff:     10 * time.Millisecond,
+		MaxTxAttempts:      100,
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = p.WipeBlock(ctx)
+	}()
+
+	// Crab-19 was still retrying, its receipt is fetched once more after the reorg
+	assert.Eventually(t, func() bool {
+		return atomic.LoadUint64(&checkpoint) == 21 && atomic.LoadInt32(&c.fetched) > 0
+	}, 10*time.Second, 10*time.Millisecond)
+	cancel()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.NotContains(t, delivered, "Crab-19")
+	assert.ElementsMatch(t, []string{"Crab-16", "Crab-17", "Crab-18", "Crab-20", "Crab-18-b", "Crab-19-b", "Crab-20-b", "Crab-21-b"}, delivered)
+}
+
+type stuckChainIo struct {
+	chainIo
+	available int32
+}
+
+func (c *stuckChainIo) ReceiptLog(tx string) (*services.Receipts, error) {
+	if tx == "Crab-15" && atomic.LoadInt32(&c.available) == 0 {
+		return nil, nil
+	}
+	return c.chainIo.ReceiptLog(tx)
+}
+
+func TestPollingDeadLetter(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		delivered []string
+	)
+	c := &stuckChainIo{chainIo: chainIo{chain: "Crab", t: t}}
+	store := services.NewMemoryDeadLetterStore()
+	p := new(Polling)
+	p.SetMetrics(metrics.NewMetrics())
+	assert.NoError(t, p.Init(services.ScanEventsOptions{
+		ChainIo:       c,
+		Chain:         "Crab",
+		GetStartBlock: func() uint64 { return 0 },
+		SetStartBlock: func(uint64) {},
+		ContractsName: map[services.ContractsAddress]services.ContractsName{"0x222": "fake"},
+		GetCallbackFunc: func(tx string, _ uint64, _ *services.Receipts) interface{} {
+			mu.Lock()
+			defer mu.Unlock()
+			delivered = append(delivered, tx)
+			return nil
+		},
+		InitBlock:       10,
+		MaxTxAttempts:   3,
+		TxRetryBackoff:  time.Millisecond,
+		DeadLetterStore: store,
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = p.WipeBlock(ctx)
+	}()
+
+	assert.Eventually(t, func() bool {
+		letters, _ := store.List("Crab")
+		return len(letters) == 1
+	}, time.Second, 10*time.Millisecond)
+	letters, err := store.List("Crab")
+	assert.NoError(t, err)
+	assert.Equal(t, "Crab-15", letters[0].Tx)
+	assert.Equal(t, 3, letters[0].Attempts)
+	mu.Lock()
+	assert.Len(t, delivered, 9)
+	mu.Unlock()
+
+	// still not available: the attempt is counted and the letter is kept
+	replayed, err := p.ReplayDeadLetters(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, replayed)
+	letters, _ = store.List("Crab")
+	assert.Equal(t, 4, letters[0].Attempts)
+
+	atomic.StoreInt32(&c.available, 1)
+	replayed, err = p.ReplayDeadLetters(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, replayed)
+	letters, _ = store.List("Crab")
+	assert.Empty(t, letters)
+	mu.Lock()
+	assert.Contains(t, delivered, "Crab-15")
+	mu.Unlock()
+}
+
+func TestWatermark(t *testing.T) {
+	var commits []uint64
+	w := NewWatermark(func(blockNum uint64) { commits = append(commits, blockNum) }, time.Hour)
+	w.Reset(10)
+
+	// block 11 has two transactions, 12 is empty, 13 has one
+	w.Add(11)
+	w.Add(11)
+	w.Scanned(11)
+	w.Scanned(12)
+	w.Add(13)
+	w.Scanned(13)
+
+	// finishing out of order does not move the checkpoint past block 11
+	w.Done(13)
+	w.Done(11)
+	assert.Empty(t, commits)
+	w.Done(11)
+	assert.Equal(t, []uint64{13}, commits)
+
+	// a transaction done before its block is scanned is committed once the block is
+	w.Add(14)
+	w.Done(14)
+	assert.Equal(t, []uint64{13}, commits)
+	w.Scanned(14)
+	assert.Equal(t, []uint64{13, 14}, commits)
+	assert.Equal(t, uint64(14), w.Committed())
+}
+
+func TestWatermarkBlockZero(t *testing.T) {
+	var commits []uint64
+	w := NewWatermark(func(blockNum uint64) { commits = append(commits, blockNum) }, time.Hour)
+	// InitBlock 0
+	w.Reset(0)
+	w.Add(0)
+	w.Add(1)
+	w.Scanned(1)
+
+	// block 0 holds the checkpoint back
+	w.Done(1)
+	assert.Empty(t, commits)
+	w.Done(0)
+	assert.Equal(t, []uint64{1}, commits)
+}
+
+func TestWatermarkEmptyBlocks(t *testing.T) {
+	var commits []uint64
+	w := NewWatermark(func(blockNum uint64) { commits = append(commits, blockNum) }, 50*time.Millisecond)
+	w.Reset(10)
+	for i := uint64(11); i <= 20; i++ {
+		w.Scanned(i)
+	}
+	assert.Empty(t, commits)
+
+	time.Sleep(50 * time.Millisecond)
+	w.Scanned(21)
+	assert.Equal(t, []uint64{21}, commits)
+}
+
+// rejectingChainIo is a ChainIoV2 whose node rejects one transaction for good.
+type rejectingChainIo struct {
+	services.ChainIoV2
+}
+
+func (c *rejectingChainIo) ReceiptLog(ctx context.Context, tx string) (*services.Receipts, error) {
+	if tx == "Crab-15" {
+		return nil, services.Permanent(fmt.Errorf("invalid transaction hash %s", tx))
+	}
+	return c.ChainIoV2.ReceiptLog(ctx, tx)
+}
+
+func TestPollingPermanentError(t *testing.T) {
+	assert.True(t, services.IsRetryable(services.ErrNotAvailable))
+	assert.False(t, services.IsRetryable(context.Canceled))
+	assert.False(t, services.IsRetryable(fmt.Errorf("wrapped: %w", services.Permanent(services.ErrNotAvailable))))
+
+	store := services.NewMemoryDeadLetterStore()
+	p := new(Polling)
+	p.SetMetrics(metrics.NewMetrics())
+	assert.NoError(t, p.Init(services.ScanEventsOptions{
+		ChainIoV2:       &rejectingChainIo{ChainIoV2: services.AdaptChainIo(&chainIo{chain: "Crab", t: t})},
+		Chain:           "Crab",
+		GetStartBlock:   func() uint64 { return 0 },
+		SetStartBlock:   func(uint64) {},
+		ContractsName:   map[services.ContractsAddress]services.ContractsName{"0x222": "fake"},
+		GetCallbackFunc: func(string, uint64, *services.Receipts) interface{} { return nil },
+		InitBlock:       10,
+		TxRetryBackoff:  time.Hour,
+		DeadLetterStore: store,
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = p.WipeBlock(ctx)
+	}()
+
+	// dead-lettered on the first failure instead of waiting for the retry backoff
+	assert.Eventually(t, func() bool {
+		letters, _ := store.List("Crab")
+		return len(letters) == 1
+	}, time.Second, 10*time.Millisecond)
+	letters, _ := store.List("Crab")
+	assert.Equal(t, 1, letters[0].Attempts)
+	assert.Equal(t, "invalid transaction hash Crab-15", letters[0].Reason)
+}
+
+// batchChainIo returns two transactions per block and counts the batch calls.
+type batchChainIo struct {
+	services.ChainIoV2
+	batches int32
+}
+
+func (c *batchChainIo) FilterTrans(_ context.Context, blockNum uint64, _ []string) (*services.BlockTrans, error) {
+	return &services.BlockTrans{
+		Txn:       []string{fmt.Sprintf("Crab-%d", blockNum), fmt.Sprintf("Crab-%d", blockNum)},
+		Contracts: []string{"0x222", "0x222"},
+		Timestamp: blockNum,
+	}, nil
+}
+
+func (c *batchChainIo) ReceiptLogs(ctx context.Context, txs []string) ([]*services.Receipts, error) {
+	atomic.AddInt32(&c.batches, 1)
+	receipts := make([]*services.Receipts, len(txs))
+	errs := make([]error, len(txs))
+	for i, tx := range txs {
+		receipts[i], errs[i] = c.ReceiptLog(ctx, tx)
+	}
+	return receipts, services.NewBatchError(errs)
+}
+
+func (c *batchChainIo) BlockHeaders(context.Context, []uint64) ([]*services.BlockHeader, error) {
+	return nil, errors.New("not implemented")
+}
+
+func TestPollingBatchReceipts(t *testing.T) {
+	var delivered int32
+	c := &batchChainIo{ChainIoV2: services.AdaptChainIo(&chainIo{chain: "Crab", t: t})}
+	p := new(Polling)
+	p.SetMetrics(metrics.NewMetrics())
+	assert.NoError(t, p.Init(services.ScanEventsOptions{
+		ChainIoV2:     c,
+		Chain:         "Crab",
+		GetStartBlock: func() uint64 { return 0 },
+		SetStartBlock: func(uint64) {},
+		ContractsName: map[services.ContractsAddress]services.ContractsName{"0x222": "fake"},
+		GetCallbackFunc: func(string, uint64, *services.Receipts) interface{} {
+			atomic.AddInt32(&delivered, 1)
+			return nil
+		},
+	}))
+	assert.NoError(t, p.ScanBlocks(context.Background(), 11, 13, false))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&c.batches))
+	assert.Equal(t, int32(6), atomic.LoadInt32(&delivered))
+}
+
+// rangeChainIo has a transaction every 10 blocks up to head and rejects ranges of more than 64 blocks,
+// and every range with the crowded block in it.
+type rangeChainIo struct {
+	services.ChainIoV2
+	head    uint64
+	crowded uint64
+	mu      sync.Mutex
+	ranges  [][2]uint64
+	blocks  []uint64
+}
+
+func (c *rangeChainIo) BlockNumber(context.Context) (uint64, error) {
+	return c.head, nil
+}
+
+func (c *rangeChainIo) trans(blockNum uint64) *services.BlockTrans {
+	if blockNum%10 != 0 {
+		return &services.BlockTrans{}
+	}
+	return &services.BlockTrans{Txn: []string{fmt.Sprintf("Crab-%d", blockNum)}, Contracts: []string{"0x222"}, Timestamp: blockNum}
+}
+
+func (c *rangeChainIo) FilterTrans(_ context.Context, blockNum uint64, _ []string) (*services.BlockTrans, error) {
+	c.mu.Lock()
+	c.blocks = append(c.blocks, blockNum)
+	c.mu.Unlock()
+	return c.trans(blockNum), nil
+}
+
+func (c *rangeChainIo) FilterRange(_ context.Context, from, to uint64, _ []string) (map[uint64]*services.BlockTrans, error) {
+	if to-from >= 64 || (c.crowded != 0 && from <= c.crowded && c.crowded <= to) {
+		return nil, services.ErrTooManyResults
+	}
+	c.mu.Lock()
+	c.ranges = append(c.ranges, [2]uint64{from, to})
+	c.mu.Unlock()
+	blocks := make(map[uint64]*services.BlockTrans)
+	for i := from; i <= to; i++ {
+		if trans := c.trans(i); len(trans.Txn) > 0 {
+			blocks[i] = trans
+		}
+	}
+	return blocks, nil
+}
+
+func TestPollingRange(t *testing.T) {
+	var (
+		delivered  int32
+		checkpoint uint64
+	)
+	c := &rangeChainIo{ChainIoV2: services.AdaptChainIo(&chainIo{chain: "Crab", t: t}), head: 1000}
+	p := new(Polling)
+	p.SetMetrics(metrics.NewMetrics())
+	assert.NoError(t, p.Init(services.ScanEventsOptions{
+		ChainIoV2:     c,
+		Chain:         "Crab",
+		GetStartBlock: func() uint64 { return 0 },
+		SetStartBlock: func(blockNum uint64) { atomic.StoreUint64(&checkpoint, blockNum) },
+		ContractsName: map[services.ContractsAddress]services.ContractsName{"0x222": "fake"},
+		GetCallbackFunc: func(string, uint64, *services.Receipts) interface{} {
+			atomic.AddInt32(&delivered, 1)
+			return nil
+		},
+		CheckpointInterval: time.Millisecond,
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = p.WipeBlock(ctx)
+	}()
+	assert.Eventually(t, func() bool {
+		return atomic.LoadUint64(&checkpoint) == 1000 && atomic.LoadInt32(&delivered) == 100
+	}, 3*time.Second, 10*time.Millisecond)
+	cancel()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// 500 was rejected down to 62, which then grew back to 124 and was rejected again
+	assert.Equal(t, [2]uint64{1, 62}, c.ranges[0])
+	for _, r := range c.ranges {
+		assert.Less(t, r[1]-r[0], uint64(64))
+	}
+	// the last 100 blocks before the head are filtered one by one
+	assert.Equal(t, uint64(900), c.ranges[len(c.ranges)-1][1])
+	assert.Equal(t, uint64(1000), c.blocks[len(c.blocks)-1])
+	assert.GreaterOrEqual(t, c.blocks[0], uint64(900))
+}
+
+func TestPollingRangeCrowdedBlock(t *testing.T) {
+	var (
+		delivered  int32
+		checkpoint uint64
+	)
+	c := &rangeChainIo{ChainIoV2: services.AdaptChainIo(&chainIo{chain: "Crab", t: t}), head: 1000, crowded: 50}
+	p := new(Polling)
+	p.SetMetrics(metrics.NewMetrics())
+	assert.NoError(t, p.Init(services.ScanEventsOptions{
+		ChainIoV2:     c,
+		Chain:         "Crab",
+		GetStartBlock: func() uint64 { return 0 },
+		SetStartBlock: func(blockNum uint64) { atomic.StoreUint64(&checkpoint, blockNum) },
+		ContractsName: map[services.ContractsAddress]services.ContractsName{"0x222": "fake"},
+		GetCallbackFunc: func(string, uint64, *services.Receipts) interface{} {
+			atomic.AddInt32(&delivered, 1)
+			return nil
+		},
+		CheckpointInterval: time.Millisecond,
+		ReorgWindow:        200,
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = p.WipeBlock(ctx)
+	}()
+	assert.Eventually(t, func() bool {
+		return atomic.LoadUint64(&checkpoint) == 1000 && atomic.LoadInt32(&delivered) == 100
+	}, 3*time.Second, 10*time.Millisecond)
+	cancel()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// block 50 is filtered alone, and the ranges go on after it
+	assert.Contains(t, c.blocks, uint64(50))
+	assert.Contains(t, c.ranges, [2]uint64{51, 52})
+	// ranges stop at the reorg window before the head
+	for _, r := range c.ranges {
+		assert.LessOrEqual(t, r[1], uint64(800))
+	}
+	assert.GreaterOrEqual(t, c.blocks[1], uint64(800))
+}
+
+// bloomChainIo has blocks 1 to 20 with blooms of the watched contract in block 5 and 15, and of
+// topic 0x01 in block 5 and 8.
+type bloomChainIo struct {
+	services.ChainIoV2
+	mu      sync.Mutex
+	batches int
+	blocks  []uint64
+}
+
+const bloomContract = "0x0000000000000000000000000000000000000222"
+
+func (c *bloomChainIo) BlockHeader(_ context.Context, blockNum uint64) (*services.BlockHeader, error) {
+	var bloom types.Bloom
+	if blockNum == 5 || blockNum == 15 {
+		bloom.Add(common.HexToAddress(bloomContract).Bytes())
+	}
+	if blockNum == 5 || blockNum == 8 {
+		bloom.Add(common.HexToHash("0x01").Bytes())
+	}
+	return &services.BlockHeader{BlockTimeStamp: blockNum, LogsBloom: hexutil.Encode(bloom.Bytes())}, nil
+}
+
+func (c *bloomChainIo) BlockHeaders(ctx context.Context, nums []uint64) ([]*services.BlockHeader, error) {
+	c.mu.Lock()
+	c.batches++
+	c.mu.Unlock()
+	headers := make([]*services.BlockHeader, len(nums))
+	for i, num := range nums {
+		headers[i], _ = c.BlockHeader(ctx, num)
+	}
+	return headers, nil
+}
+
+func (c *bloomChainIo) ReceiptLogs(ctx context.Context, txs []string) ([]*services.Receipts, error) {
+	receipts := make([]*services.Receipts, len(txs))
+	for i, tx := range txs {
+		receipts[i], _ = c.ReceiptLog(ctx, tx)
+	}
+	return receipts, nil
+}
+
+func (c *bloomChainIo) FilterTrans(ctx context.Context, blockNum uint64, filter []string) (*services.BlockTrans, error) {
+	c.mu.Lock()
+	c.blocks = append(c.blocks, blockNum)
+	c.mu.Unlock()
+	return c.ChainIoV2.FilterTrans(ctx, blockNum, filter)
+}
+
+func TestPollingBloomFilter(t *testing.T) {
+	var (
+		mu         sync.Mutex
+		delivered  []string
+		checkpoint uint64
+	)
+	c := &bloomChainIo{ChainIoV2: services.AdaptChainIo(&chainIo{chain: "Crab", t: t})}
+	p := new(Polling)
+	p.SetMetrics(metrics.NewMetrics())
+	assert.NoError(t, p.Init(services.ScanEventsOptions{
+		ChainIoV2:     c,
+		Chain:         "Crab",
+		GetStartBlock: func() uint64 { return 0 },
+		SetStartBlock: func(blockNum uint64) { atomic.StoreUint64(&checkpoint, blockNum) },
+		ContractsName: map[services.ContractsAddress]services.ContractsName{bloomContract: "fake"},
+		GetCallbackFunc: func(tx string, _ uint64, _ *services.Receipts) interface{} {
+			mu.Lock()
+			defer mu.Unlock()
+			delivered = append(delivered, tx)
+			return nil
+		},
+		CheckpointInterval: time.Millisecond,
+		BloomFilter:        true,
+		Topics:             []string{"0x01"},
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = p.WipeBlock(ctx)
+	}()
+	assert.Eventually(t, func() bool {
+		return atomic.LoadUint64(&checkpoint) == 20
+	}, 3*time.Second, 10*time.Millisecond)
+	cancel()
+
+	mu.Lock()
+	assert.Equal(t, []string{"Crab-5"}, delivered)
+	mu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	assert.Equal(t, []uint64{5}, c.blocks)
+	assert.Equal(t, 1, c.batches)
+}
+
+func TestPollingSinkError(t *testing.T) {
+	var (
+		mu         sync.Mutex
+		sent       = make(map[string]int)
+		failed     bool
+		checkpoint uint64
+	)
+	p := new(Polling)
+	p.SetMetrics(metrics.NewMetrics())
+	assert.NoError(t, p.Init(services.ScanEventsOptions{
+		ChainIo:              &chainIo{chain: "Crab", t: t},
+		Chain:                "Crab",
+		GetStartBlock:        func() uint64 { return 0 },
+		SetStartBlock:        func(blockNum uint64) { atomic.StoreUint64(&checkpoint, blockNum) },
+		ContractsName:        map[services.ContractsAddress]services.ContractsName{"0x222": "fake"},
+		CallbackMethodPrefix: []string{"fake"},
+		GetCallbackFunc:      func(string, uint64, *services.Receipts) interface{} { return nil },
+		InitBlock:            10,
+		CheckpointInterval:   time.Millisecond,
+		TxRetryBackoff:       time.Millisecond,
+		Sink: services.SinkFunc(func(_ context.Context, fb *services.FilterBlock) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if fb.Txid == "Crab-12" && !failed {
+				failed = true
+				return errors.New("queue is down")
+			}
+			assert.Equal(t, "fake", fb.ContractName)
+			sent[fb.Txid]++
+			return nil
+		}),
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = p.WipeBlock(ctx)
+	}()
+	assert.Eventually(t, func() bool {
+		return atomic.LoadUint64(&checkpoint) == 20
+	}, 3*time.Second, 10*time.Millisecond)
+	cancel()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.True(t, failed)
+	assert.Len(t, sent, 10)
+	assert.Equal(t, 1, sent["Crab-12"])
+}
+
+func TestPollingSinkDown(t *testing.T) {
+	var (
+		mu         sync.Mutex
+		failures   int
+		sent       = make(map[string]int)
+		checkpoint uint64
+		held       = true
+	)
+	store := services.NewMemoryDeadLetterStore()
+	p := new(Polling)
+	p.SetMetrics(metrics.NewMetrics())
+	assert.NoError(t, p.Init(services.ScanEventsOptions{
+		ChainIo:       &chainIo{chain: "Crab", t: t},
+		Chain:         "Crab",
+		GetStartBlock: func() uint64 { return 0 },
+		SetStartBlock: func(blockNum uint64) {
+			mu.Lock()
+			defer mu.Unlock()
+			// the checkpoint never passes the undelivered transaction
+			if blockNum >= 12 && sent["Crab-12"] == 0 {
+				held = false
+			}
+			atomic.StoreUint64(&checkpoint, blockNum)
+		},
+		ContractsName:        map[services.ContractsAddress]services.ContractsName{"0x222": "fake"},
+		CallbackMethodPrefix: []string{"fake"},
+		GetCallbackFunc:      func(string, uint64, *services.Receipts) interface{} { return nil },
+		InitBlock:            10,
+		CheckpointInterval:   time.Millisecond,
+		MaxTxAttempts:        3,
+		TxRetryBackoff:       time.Millisecond,
+		DeadLetterStore:      store,
+		Sink: services.SinkFunc(func(_ context.Context, fb *services.FilterBlock) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if fb.Txid == "Crab-12" && failures < 6 {
+				failures++
+				return errors.New("webhook is down")
+			}
+			sent[fb.Txid]++
+			return nil
+		}),
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = p.WipeBlock(ctx)
+	}()
+	assert.Eventually(t, func() bool {
+		return atomic.LoadUint64(&checkpoint) == 20
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 6, failures)
+	assert.True(t, held)
+	assert.Equal(t, 1, sent["Crab-12"])
+	letters, err := store.List("Crab")
+	assert.NoError(t, err)
+	assert.Empty(t, letters)
+}
+
+func TestChanSink(t *testing.T) {
+	ch := make(chan *services.FilterBlock, 1)
+	sink := services.ChanSink(ch)
+	assert.NoError(t, sink.Send(context.Background(), &services.FilterBlock{Txid: "0x1"}))
+	assert.Equal(t, "0x1", (<-ch).Txid)
+
+	assert.NoError(t, sink.Send(context.Background(), &services.FilterBlock{Txid: "0x2"}))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// the channel is full
+	assert.ErrorIs(t, sink.Send(ctx, &services.FilterBlock{Txid: "0x3"}), context.Canceled)
+}
+
+func TestPollingHandlers(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		events []*services.Event
+	)
+	opt := services.ScanEventsOptions{
+		ChainIo:       &chainIo{chain: "Crab", t: t},
+		Chain:         "Crab",
+		GetStartBlock: func() uint64 { return 0 },
+		SetStartBlock: func(uint64) {},
+		ContractsName: map[services.ContractsAddress]services.ContractsName{"0x222": "Fake"},
+		InitBlock:     17,
+	}
+	opt.Handle("fake", func(_ context.Context, event *services.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+		return nil
+	})
+	p := new(Polling)
+	p.SetMetrics(metrics.NewMetrics())
+	assert.NoError(t, p.Init(opt))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = p.WipeBlock(ctx)
+	}()
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(events) == 3
+	}, 3*time.Second, 10*time.Millisecond)
+	cancel()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, "Crab:18:Crab-18:0", events[0].ID)
+	assert.Equal(t, "fake", events[0].ContractName)
+	assert.Equal(t, "Crab-18", events[0].Receipts.Logs[0].Data)
+}
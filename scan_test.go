@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/evolutionlandorg/block-scan/metrics"
 	"github.com/evolutionlandorg/block-scan/services"
 	"github.com/stretchr/testify/assert"
 )
@@ -94,3 +95,54 @@ func TestStartScanChainEvents(t *testing.T) {
 	assert.Equal(t, f.receipt.BlockNumber, "1")
 
 }
+
+type fakeScan struct {
+	opt services.ScanEventsOptions
+}
+
+func (f *fakeScan) Init(opt services.ScanEventsOptions) error {
+	f.opt = opt
+	return nil
+}
+
+func (f *fakeScan) WipeBlock(_ context.Context) error {
+	f.opt.SetStartBlock(f.opt.InitBlock)
+	return nil
+}
+
+func (f *fakeScan) SetMetrics(_ metrics.Metrics) {}
+
+// unregisterScanType removes a scan type registered by a test, so the test can run again.
+func unregisterScanType(name ScanType) {
+	scanTypesMu.Lock()
+	defer scanTypesMu.Unlock()
+	delete(scanTypes, name)
+}
+
+func TestRegisterScanType(t *testing.T) {
+	var checkpoint uint64
+	RegisterScanType("fake", func() services.Scan { return new(fakeScan) })
+	t.Cleanup(func() { unregisterScanType("fake") })
+	assert.Panics(t, func() {
+		RegisterScanType("fake", func() services.Scan { return new(fakeScan) })
+	})
+	assert.Contains(t, ScanTypes(), ScanType("fake"))
+
+	opt := services.ScanEventsOptions{
+		ChainIo:       new(MockChainIo),
+		GetStartBlock: func() uint64 { return 0 },
+		SetStartBlock: func(currentBlockNum uint64) { checkpoint = currentBlockNum },
+		Chain:         "Crab",
+		ContractsName: map[services.ContractsAddress]services.ContractsName{
+			services.ContractsAddress("222"): services.ContractsName("fake"),
+		},
+		GetCallbackFunc: func(tx string, blockTimestamp uint64, receipt *services.Receipts) interface{} {
+			return nil
+		},
+		InitBlock: 7,
+	}
+	assert.NoError(t, StartScanChainEvents(context.Background(), "fake", opt))
+	assert.Equal(t, uint64(7), checkpoint)
+
+	assert.EqualError(t, StartScanChainEvents(context.Background(), "unknown", opt), "not implement 'unknown' type")
+}
@@ -0,0 +1,215 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrNotAvailable is returned when the node has no answer yet, e.g. a receipt that is not indexed.
+// It is retryable.
+var ErrNotAvailable = errors.New("not available")
+
+// ErrNotSupported is returned by ChainIo middleware for an optional call the ChainIo it wraps does not have.
+var ErrNotSupported = Permanent(errors.New("not supported"))
+
+// ErrTooManyResults is returned by RangeChainIo.FilterRange when the node refuses a range because
+// it holds too many logs. A smaller range may succeed.
+var ErrTooManyResults = errors.New("too many results")
+
+type TxStatus string
+
+const (
+	TxStatusSuccess TxStatus = "Success"
+	TxStatusFail    TxStatus = "Fail"
+)
+
+// BlockTrans is the result of ChainIoV2.FilterTrans. Txn, Contracts and TransactionTo have the same length.
+type BlockTrans struct {
+	Txn           []string
+	Contracts     []string
+	Timestamp     uint64
+	TransactionTo []string
+}
+
+// ChainIoV2 is ChainIo with cancellation and error reporting. Implementations should return
+// errors wrapped with Permanent when retrying cannot help, such as an invalid request.
+type ChainIoV2 interface {
+	ReceiptLog(ctx context.Context, tx string) (*Receipts, error)
+	BlockNumber(ctx context.Context) (uint64, error)
+	FilterTrans(ctx context.Context, blockNum uint64, filter []string) (*BlockTrans, error)
+	BlockHeader(ctx context.Context, blockNum uint64) (*BlockHeader, error)
+	GetTransactionStatus(ctx context.Context, tx string) (TxStatus, error)
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks err as not retryable.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+func IsPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+// IsRetryable reports whether the call that returned err may succeed if it is tried again.
+// Permanent errors and cancellations are not retryable.
+func IsRetryable(err error) bool {
+	return err != nil && !IsPermanent(err) && !errors.Is(err, context.Canceled)
+}
+
+// AdaptChainIo wraps a ChainIo as a ChainIoV2. The old interface cannot be cancelled, so ctx is only
+// checked before each call, and failures it cannot report are guessed: a zero block number and a
+// missing header become ErrNotAvailable.
+func AdaptChainIo(c ChainIo) ChainIoV2 {
+	return &chainIoAdapter{c: c}
+}
+
+type chainIoAdapter struct {
+	c ChainIo
+}
+
+func (a *chainIoAdapter) ReceiptLog(ctx context.Context, tx string) (*Receipts, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.c.ReceiptLog(tx)
+}
+
+func (a *chainIoAdapter) BlockNumber(ctx context.Context) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	blockNum := a.c.BlockNumber()
+	if blockNum == 0 {
+		return 0, fmt.Errorf("block number: %w", ErrNotAvailable)
+	}
+	return blockNum, nil
+}
+
+func (a *chainIoAdapter) FilterTrans(ctx context.Context, blockNum uint64, filter []string) (*BlockTrans, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	txn, contracts, timestamp, transactionTo := a.c.FilterTrans(blockNum, filter)
+	return &BlockTrans{Txn: txn, Contracts: contracts, Timestamp: timestamp, TransactionTo: transactionTo}, nil
+}
+
+func (a *chainIoAdapter) BlockHeader(ctx context.Context, blockNum uint64) (*BlockHeader, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	header := a.c.BlockHeader(blockNum)
+	if header == nil {
+		return nil, fmt.Errorf("block header %d: %w", blockNum, ErrNotAvailable)
+	}
+	return header, nil
+}
+
+func (a *chainIoAdapter) GetTransactionStatus(ctx context.Context, tx string) (TxStatus, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return TxStatus(a.c.GetTransactionStatus(tx)), nil
+}
+
+// BatchChainIo is implemented by a ChainIoV2 that can fetch many receipts or block headers in one
+// round trip. The results line up with the arguments and are nil for receipts and blocks that are not
+// available yet. The receipt of a failed transaction has Status "0x0". When some elements fail the
+// others are still returned, together with a *BatchError.
+type BatchChainIo interface {
+	ReceiptLogs(ctx context.Context, txs []string) ([]*Receipts, error)
+	BlockHeaders(ctx context.Context, nums []uint64) ([]*BlockHeader, error)
+}
+
+// RangeChainIo is implemented by a ChainIoV2 that can filter a range of blocks in one query, such as
+// eth_getLogs. FilterRange returns the transactions of the blocks in [from, to] that have any, by block
+// number. TransactionTo may be left empty.
+type RangeChainIo interface {
+	FilterRange(ctx context.Context, from, to uint64, filter []string) (map[uint64]*BlockTrans, error)
+}
+
+// BatchError holds the errors of the failed elements of a batch call by index.
+type BatchError struct {
+	Errors map[int]error
+}
+
+// NewBatchError returns a *BatchError for the non-nil errs, or nil if there are none.
+func NewBatchError(errs []error) error {
+	batchErr := &BatchError{Errors: make(map[int]error)}
+	for i, err := range errs {
+		if err != nil {
+			batchErr.Errors[i] = err
+		}
+	}
+	if len(batchErr.Errors) == 0 {
+		return nil
+	}
+	return batchErr
+}
+
+func (e *BatchError) Error() string {
+	first := -1
+	for i := range e.Errors {
+		if first < 0 || i < first {
+			first = i
+		}
+	}
+	return fmt.Sprintf("%d batch elements failed, element %d: %v", len(e.Errors), first, e.Errors[first])
+}
+
+func (e *BatchError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// BatchErr returns the error of element i of a batch call that returned err, or err itself if it is not a *BatchError.
+func BatchErr(err error, i int) error {
+	var batchErr *BatchError
+	if errors.As(err, &batchErr) {
+		return batchErr.Errors[i]
+	}
+	return err
+}
+
+// Priority orders the ChainIo calls waiting for a rate limit. Lower values go first.
+type Priority int
+
+const (
+	// PriorityHead is for following the chain head, the default
+	PriorityHead Priority = iota
+	// PriorityBackfill is for backfills, rescans and dead-letter replays
+	PriorityBackfill
+)
+
+type priorityKey struct{}
+
+// WithPriority returns a context whose ChainIo calls wait with priority p.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+func PriorityFrom(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityKey{}).(Priority); ok {
+		return p
+	}
+	return PriorityHead
+}
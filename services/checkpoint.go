@@ -0,0 +1,130 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/evolutionlandorg/block-scan/util/log"
+)
+
+// ErrCheckpointConflict is returned by CheckpointStore.Save when the stored version is not the expected one.
+var ErrCheckpointConflict = errors.New("checkpoint was saved by another writer")
+
+type Checkpoint struct {
+	BlockNum uint64 `json:"block_num"`
+	// Version is incremented on every save
+	Version uint64 `json:"version"`
+}
+
+// CheckpointStore persists the checkpoint of each chain.
+// Save stores cp.BlockNum only if the stored version still equals cp.Version, and returns
+// the checkpoint with its new version. Otherwise it returns ErrCheckpointConflict.
+type CheckpointStore interface {
+	Load(chain string) (Checkpoint, error)
+	Save(chain string, cp Checkpoint) (Checkpoint, error)
+}
+
+// loadAttempts is how many times StoreCheckpoint.Load tries the store, loadBackoff the delay between tries
+var (
+	loadAttempts = 5
+	loadBackoff  = RestartPolicy{InitialBackoff: time.Second, MaxBackoff: 30 * time.Second, Multiplier: 2}
+)
+
+// StoreCheckpoint keeps the checkpoint of one chain in a CheckpointStore. Set never moves the stored
+// checkpoint backwards, whoever saved it; only Rewind does, for a reorg or an explicit SetCheckpoint.
+type StoreCheckpoint struct {
+	store CheckpointStore
+	chain string
+
+	mu sync.Mutex
+	// version and block are the last stored checkpoint this writer has seen
+	version uint64
+	block   uint64
+}
+
+func NewStoreCheckpoint(store CheckpointStore, chain string) *StoreCheckpoint {
+	return &StoreCheckpoint{store: store, chain: chain}
+}
+
+// CheckpointFuncs returns the Get and Set methods of a StoreCheckpoint, for GetStartBlock and SetStartBlock.
+func CheckpointFuncs(store CheckpointStore, chain string) (get func() uint64, set func(currentBlockNum uint64)) {
+	c := NewStoreCheckpoint(store, chain)
+	return c.Get, c.Set
+}
+
+// Load reads the stored checkpoint. It tries the store loadAttempts times and stops early when ctx is done.
+func (c *StoreCheckpoint) Load(ctx context.Context) (uint64, error) {
+	for attempt := 1; ; attempt++ {
+		cp, err := c.store.Load(c.chain)
+		if err == nil {
+			c.mu.Lock()
+			c.version, c.block = cp.Version, cp.BlockNum
+			c.mu.Unlock()
+			return cp.BlockNum, nil
+		}
+		if attempt >= loadAttempts {
+			return 0, fmt.Errorf("%s load checkpoint: %w", c.chain, err)
+		}
+		backoff := loadBackoff.Backoff(attempt)
+		log.Warn("%s load checkpoint error: %v. trying again in %s", c.chain, err, backoff)
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// Get is Load without a context. When the store keeps failing it returns the last checkpoint it saw.
+func (c *StoreCheckpoint) Get() uint64 {
+	blockNum, err := c.Load(context.Background())
+	if err != nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		log.Error("%v. using checkpoint %d", err, c.block)
+		return c.block
+	}
+	return blockNum
+}
+
+// Set stores currentBlockNum unless the stored checkpoint is already at or above it.
+func (c *StoreCheckpoint) Set(currentBlockNum uint64) {
+	c.save(currentBlockNum, false)
+}
+
+// Rewind stores currentBlockNum even if it is below the stored checkpoint.
+func (c *StoreCheckpoint) Rewind(currentBlockNum uint64) {
+	c.save(currentBlockNum, true)
+}
+
+func (c *StoreCheckpoint) save(currentBlockNum uint64, rewind bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for try := 0; try < 3; try++ {
+		if !rewind && currentBlockNum <= c.block {
+			if currentBlockNum < c.block {
+				log.Warn("%s checkpoint is at %d, not moving it back to %d", c.chain, c.block, currentBlockNum)
+			}
+			return
+		}
+		cp, err := c.store.Save(c.chain, Checkpoint{BlockNum: currentBlockNum, Version: c.version})
+		if err == nil {
+			c.version, c.block = cp.Version, cp.BlockNum
+			return
+		}
+		if !errors.Is(err, ErrCheckpointConflict) {
+			log.Error("%s save checkpoint %d error: %v", c.chain, currentBlockNum, err)
+			return
+		}
+		latest, err := c.store.Load(c.chain)
+		if err != nil {
+			log.Error("%s load checkpoint error: %v", c.chain, err)
+			return
+		}
+		c.version, c.block = latest.Version, latest.BlockNum
+	}
+	log.Error("%s save checkpoint %d conflicted too many times", c.chain, currentBlockNum)
+}
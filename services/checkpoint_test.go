@@ -0,0 +1,57 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyStore fails the first failures loads.
+type flakyStore struct {
+	failures int
+	loads    int
+}
+
+func (s *flakyStore) Load(string) (Checkpoint, error) {
+	if s.loads++; s.loads <= s.failures {
+		return Checkpoint{}, errors.New("connection refused")
+	}
+	return Checkpoint{BlockNum: 10, Version: 1}, nil
+}
+
+func (s *flakyStore) Save(_ string, cp Checkpoint) (Checkpoint, error) {
+	cp.Version++
+	return cp, nil
+}
+
+func TestStoreCheckpointLoadError(t *testing.T) {
+	backoff := loadBackoff
+	loadBackoff = RestartPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, Multiplier: 2}
+	t.Cleanup(func() { loadBackoff = backoff })
+
+	store := &flakyStore{failures: 3}
+	c := NewStoreCheckpoint(store, "eth")
+	blockNum, err := c.Load(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(10), blockNum)
+	assert.Equal(t, 4, store.loads)
+
+	// the store stays down: Load gives up, Get falls back to the last checkpoint it saw
+	store.failures, store.loads = 100, 0
+	_, err = c.Load(context.Background())
+	assert.ErrorContains(t, err, "connection refused")
+	assert.Equal(t, loadAttempts, store.loads)
+	assert.Equal(t, uint64(10), c.Get())
+
+	// a done ctx stops the retries
+	loadBackoff = RestartPolicy{InitialBackoff: time.Hour, MaxBackoff: time.Hour, Multiplier: 2}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	store.loads = 0
+	_, err = c.Load(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 1, store.loads)
+}
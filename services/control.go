@@ -0,0 +1,163 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+type BlockRange struct {
+	From uint64
+	To   uint64
+}
+
+// Control carries operator requests to a running scanner: pause, resume,
+// rescan a block range, move the checkpoint and replay dead-lettered transactions.
+// All methods are safe to call on a nil *Control, which never pauses and has nothing pending.
+type Control struct {
+	mu         sync.Mutex
+	resume     chan struct{}
+	rescans    []BlockRange
+	checkpoint *uint64
+	replay     bool
+	progress   atomic.Uint64
+}
+
+func NewControl() *Control {
+	return new(Control)
+}
+
+func (c *Control) Pause() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.resume == nil {
+		c.resume = make(chan struct{})
+	}
+}
+
+func (c *Control) Resume() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.resume != nil {
+		close(c.resume)
+		c.resume = nil
+	}
+}
+
+func (c *Control) Paused() bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.resume != nil
+}
+
+// Wait blocks while the scanner is paused. It returns ctx.Err() if ctx is done first.
+func (c *Control) Wait(ctx context.Context) error {
+	if c == nil {
+		return ctx.Err()
+	}
+	c.mu.Lock()
+	resume := c.resume
+	c.mu.Unlock()
+	if resume == nil {
+		return ctx.Err()
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-resume:
+		return nil
+	}
+}
+
+// Rescan asks the scanner to deliver the events in [from, to] again without moving the checkpoint.
+func (c *Control) Rescan(from, to uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rescans = append(c.rescans, BlockRange{From: from, To: to})
+}
+
+// TakeRescans returns and clears the pending rescan requests.
+func (c *Control) TakeRescans() []BlockRange {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rescans := c.rescans
+	c.rescans = nil
+	return rescans
+}
+
+// SetCheckpoint asks the scanner to continue from blockNum.
+func (c *Control) SetCheckpoint(blockNum uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checkpoint = &blockNum
+}
+
+// TakeCheckpoint returns and clears the pending checkpoint request.
+func (c *Control) TakeCheckpoint() (uint64, bool) {
+	if c == nil {
+		return 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.checkpoint == nil {
+		return 0, false
+	}
+	blockNum := *c.checkpoint
+	c.checkpoint = nil
+	return blockNum, true
+}
+
+// ReplayDeadLetters asks the scanner to retry its dead-lettered transactions.
+func (c *Control) ReplayDeadLetters() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.replay = true
+}
+
+// TakeReplay returns and clears the pending dead-letter replay request.
+func (c *Control) TakeReplay() bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	replay := c.replay
+	c.replay = false
+	return replay
+}
+
+// SetProgress records the last block the scanner has scanned.
+func (c *Control) SetProgress(blockNum uint64) {
+	if c == nil {
+		return
+	}
+	c.progress.Store(blockNum)
+}
+
+func (c *Control) Progress() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.progress.Load()
+}
@@ -0,0 +1,57 @@
+package services
+
+import (
+	"sync"
+	"time"
+)
+
+// DeadLetter is a transaction whose receipt never became available.
+type DeadLetter struct {
+	Tnx
+	Chain       string
+	Reason      string
+	LastAttempt time.Time
+}
+
+// DeadLetterStore keeps dead-lettered transactions until they are replayed.
+type DeadLetterStore interface {
+	Put(letter DeadLetter) error
+	List(chain string) ([]DeadLetter, error)
+	Delete(chain, tx string) error
+}
+
+type MemoryDeadLetterStore struct {
+	mu      sync.Mutex
+	letters map[string]map[string]DeadLetter
+}
+
+func NewMemoryDeadLetterStore() *MemoryDeadLetterStore {
+	return &MemoryDeadLetterStore{letters: make(map[string]map[string]DeadLetter)}
+}
+
+func (m *MemoryDeadLetterStore) Put(letter DeadLetter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.letters[letter.Chain] == nil {
+		m.letters[letter.Chain] = make(map[string]DeadLetter)
+	}
+	m.letters[letter.Chain][letter.Tx] = letter
+	return nil
+}
+
+func (m *MemoryDeadLetterStore) List(chain string) ([]DeadLetter, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var list []DeadLetter
+	for _, v := range m.letters[chain] {
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+func (m *MemoryDeadLetterStore) Delete(chain, tx string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.letters[chain], tx)
+	return nil
+}
@@ -0,0 +1,286 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/spf13/cast"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// EventSchemaVersion is the SchemaVersion of the events built by this version. It changes only when a
+// field changes meaning or is removed; new fields keep it.
+const EventSchemaVersion = 1
+
+// Event is the payload delivered for each transaction and contract. Its JSON keys are those of the
+// untyped task payload it replaces, and its protobuf encoding is the Event message of event.proto.
+type Event struct {
+	SchemaVersion int `json:"schema_version"`
+	// ID is "<chain>:<block>:<tx>:<log index>", the same for every delivery of the event, so consumers
+	// can drop duplicates. It is encoded as task_id
+	ID          string `json:"task_id"`
+	Chain       string `json:"chain"`
+	BlockNumber uint64 `json:"block_number"`
+	Tx          string `json:"tx"`
+	// Position is the index in Receipts.Logs of the first log of the contract, after duplicate logs
+	// were removed. It is not the logIndex of the log in the block
+	Position       int       `json:"position"`
+	ContractName   string    `json:"contract_name"`
+	BlockTimestamp uint64    `json:"block_timestamp"`
+	Receipts       *Receipts `json:"receipts"`
+	// LogIndex is the index of the first log of the contract in the block, see Log.BlockIndex
+	LogIndex uint64 `json:"log_index"`
+}
+
+// EventID returns the ID of the event of the log at logIndex in the block.
+func EventID(chain string, blockNum uint64, tx string, logIndex uint64) string {
+	return fmt.Sprintf("%s:%d:%s:%d", chain, blockNum, tx, logIndex)
+}
+
+// BlockIndex returns the index of l in its block. Receipts of chains that do not report it fall back to
+// position, the index of l in the receipt logs.
+func (l Log) BlockIndex(position int) uint64 {
+	if index, err := hexutil.DecodeUint64(l.LogIndex); err == nil {
+		return index
+	}
+	return uint64(position)
+}
+
+// Event returns the typed payload of fb.
+func (fb *FilterBlock) Event() *Event {
+	blockNum := cast.ToUint64(fb.Receipts.BlockNumber)
+	return &Event{
+		SchemaVersion:  EventSchemaVersion,
+		ID:             EventID(fb.Receipts.ChainSource, blockNum, fb.Txid, fb.LogIndex),
+		Chain:          fb.Receipts.ChainSource,
+		BlockNumber:    blockNum,
+		Tx:             fb.Txid,
+		Position:       fb.Position,
+		ContractName:   fb.ContractName,
+		BlockTimestamp: fb.BlockTimestamp,
+		Receipts:       fb.Receipts,
+		LogIndex:       fb.LogIndex,
+	}
+}
+
+// UnmarshalEvent decodes the JSON encoding of an event and checks its schema version.
+func UnmarshalEvent(data []byte) (*Event, error) {
+	var e Event
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+	return &e, e.CheckVersion()
+}
+
+// CheckVersion returns an error if the schema version of e is not EventSchemaVersion.
+func (e *Event) CheckVersion() error {
+	if e.SchemaVersion != EventSchemaVersion {
+		return fmt.Errorf("event %s schema version %d, want %d", e.ID, e.SchemaVersion, EventSchemaVersion)
+	}
+	return nil
+}
+
+// Field numbers of event.proto.
+const (
+	eventSchemaVersion  protowire.Number = 1
+	eventID             protowire.Number = 2
+	eventChain          protowire.Number = 3
+	eventBlockNumber    protowire.Number = 4
+	eventTx             protowire.Number = 5
+	eventPosition       protowire.Number = 6
+	eventContractName   protowire.Number = 7
+	eventBlockTimestamp protowire.Number = 8
+	eventReceipt        protowire.Number = 9
+	eventLogIndex       protowire.Number = 10
+
+	receiptBlockNumber      protowire.Number = 1
+	receiptLogs             protowire.Number = 2
+	receiptStatus           protowire.Number = 3
+	receiptChainSource      protowire.Number = 4
+	receiptGasUsed          protowire.Number = 5
+	receiptLogsBloom        protowire.Number = 6
+	receiptSolidity         protowire.Number = 7
+	receiptTransactionIndex protowire.Number = 8
+	receiptBlockHash        protowire.Number = 9
+
+	logTopics   protowire.Number = 1
+	logData     protowire.Number = 2
+	logAddress  protowire.Number = 3
+	logLogIndex protowire.Number = 4
+)
+
+// MarshalProto returns the protobuf encoding of e. Fields are written in field number order and
+// zero values are left out, so equal events encode to equal bytes.
+func (e *Event) MarshalProto() []byte {
+	var b []byte
+	b = appendVarint(b, eventSchemaVersion, uint64(e.SchemaVersion))
+	b = appendString(b, eventID, e.ID)
+	b = appendString(b, eventChain, e.Chain)
+	b = appendVarint(b, eventBlockNumber, e.BlockNumber)
+	b = appendString(b, eventTx, e.Tx)
+	b = appendVarint(b, eventPosition, uint64(e.Position))
+	b = appendString(b, eventContractName, e.ContractName)
+	b = appendVarint(b, eventBlockTimestamp, e.BlockTimestamp)
+	if r := e.Receipts; r != nil {
+		var rb []byte
+		rb = appendString(rb, receiptBlockNumber, r.BlockNumber)
+		for _, l := range r.Logs {
+			var lb []byte
+			for _, topic := range l.Topics {
+				lb = protowire.AppendTag(lb, logTopics, protowire.BytesType)
+				lb = protowire.AppendString(lb, topic)
+			}
+			lb = appendString(lb, logData, l.Data)
+			lb = appendString(lb, logAddress, l.Address)
+			lb = appendString(lb, logLogIndex, l.LogIndex)
+			rb = protowire.AppendTag(rb, receiptLogs, protowire.BytesType)
+			rb = protowire.AppendBytes(rb, lb)
+		}
+		rb = appendString(rb, receiptStatus, r.Status)
+		rb = appendString(rb, receiptChainSource, r.ChainSource)
+		rb = appendString(rb, receiptGasUsed, r.GasUsed)
+		rb = appendString(rb, receiptLogsBloom, r.LogsBloom)
+		if r.Solidity {
+			rb = appendVarint(rb, receiptSolidity, 1)
+		}
+		rb = appendString(rb, receiptTransactionIndex, r.TransactionIndex)
+		rb = appendString(rb, receiptBlockHash, r.BlockHash)
+		b = protowire.AppendTag(b, eventReceipt, protowire.BytesType)
+		b = protowire.AppendBytes(b, rb)
+	}
+	b = appendVarint(b, eventLogIndex, e.LogIndex)
+	return b
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// UnmarshalEventProto decodes the protobuf encoding of an event and checks its schema version.
+// Unknown fields are skipped.
+func UnmarshalEventProto(data []byte) (*Event, error) {
+	e := new(Event)
+	err := consumeFields(data, func(num protowire.Number, v uint64, s []byte) {
+		switch num {
+		case eventSchemaVersion:
+			e.SchemaVersion = int(v)
+		case eventID:
+			e.ID = string(s)
+		case eventChain:
+			e.Chain = string(s)
+		case eventBlockNumber:
+			e.BlockNumber = v
+		case eventTx:
+			e.Tx = string(s)
+		case eventPosition:
+			e.Position = int(v)
+		case eventContractName:
+			e.ContractName = string(s)
+		case eventBlockTimestamp:
+			e.BlockTimestamp = v
+		case eventReceipt:
+			e.Receipts = new(Receipts)
+		case eventLogIndex:
+			e.LogIndex = v
+		}
+	}, func(num protowire.Number, s []byte) error {
+		if num != eventReceipt {
+			return nil
+		}
+		return unmarshalReceipt(s, e.Receipts)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e, e.CheckVersion()
+}
+
+func unmarshalReceipt(data []byte, r *Receipts) error {
+	return consumeFields(data, func(num protowire.Number, v uint64, s []byte) {
+		switch num {
+		case receiptBlockNumber:
+			r.BlockNumber = string(s)
+		case receiptStatus:
+			r.Status = string(s)
+		case receiptChainSource:
+			r.ChainSource = string(s)
+		case receiptGasUsed:
+			r.GasUsed = string(s)
+		case receiptLogsBloom:
+			r.LogsBloom = string(s)
+		case receiptSolidity:
+			r.Solidity = v != 0
+		case receiptTransactionIndex:
+			r.TransactionIndex = string(s)
+		case receiptBlockHash:
+			r.BlockHash = string(s)
+		}
+	}, func(num protowire.Number, s []byte) error {
+		if num != receiptLogs {
+			return nil
+		}
+		var l Log
+		err := consumeFields(s, func(num protowire.Number, _ uint64, s []byte) {
+			switch num {
+			case logTopics:
+				l.Topics = append(l.Topics, string(s))
+			case logData:
+				l.Data = string(s)
+			case logAddress:
+				l.Address = string(s)
+			case logLogIndex:
+				l.LogIndex = string(s)
+			}
+		}, nil)
+		r.Logs = append(r.Logs, l)
+		return err
+	})
+}
+
+// consumeFields calls field for each varint and length-delimited field of a message, then message for
+// the length-delimited ones that are embedded messages, if set. Other wire types are skipped.
+func consumeFields(data []byte, field func(num protowire.Number, v uint64, s []byte), message func(num protowire.Number, s []byte) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		var (
+			v uint64
+			s []byte
+		)
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(data)
+		case protowire.BytesType:
+			s, n = protowire.ConsumeBytes(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		field(num, v, s)
+		if typ == protowire.BytesType && message != nil {
+			if err := message(num, s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
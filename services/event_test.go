@@ -0,0 +1,59 @@
+package services
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvent(t *testing.T) {
+	fb := &FilterBlock{
+		ContractName:   "Transfer",
+		Txid:           "0xa1",
+		BlockTimestamp: 1000,
+		Position:       1,
+		LogIndex:       26,
+		Receipts: &Receipts{
+			BlockNumber: "12",
+			ChainSource: "Crab",
+			Status:      "0x1",
+			Solidity:    true,
+			Logs: []Log{
+				{Address: "0x111", Topics: []string{"0x01"}},
+				{Address: "0x222", Topics: []string{"0x01", "0x02"}, Data: "0x", LogIndex: "0x1a"},
+			},
+		},
+	}
+	event := fb.Event()
+	// the log index in the block, not the position in the receipt
+	assert.Equal(t, "Crab:12:0xa1:26", event.ID)
+	assert.Equal(t, uint64(26), fb.Receipts.Logs[1].BlockIndex(1))
+	assert.Equal(t, uint64(0), fb.Receipts.Logs[0].BlockIndex(0))
+	assert.Equal(t, uint64(12), event.BlockNumber)
+
+	data, err := json.Marshal(event)
+	assert.NoError(t, err)
+	var payload map[string]interface{}
+	assert.NoError(t, json.Unmarshal(data, &payload))
+	for _, key := range []string{"tx", "contract_name", "task_id", "block_timestamp", "chain", "receipts", "schema_version", "position", "log_index"} {
+		assert.Contains(t, payload, key)
+	}
+	decoded, err := UnmarshalEvent(data)
+	assert.NoError(t, err)
+	assert.Equal(t, event, decoded)
+
+	// the encoding of the Event message of event.proto, which must not change
+	proto := event.MarshalProto()
+	assert.Equal(t, "0801120f437261623a31323a307861313a32361a0443726162200c2a043078613130013a085472616e7366657240e8074a3f0a023132"+
+		"120d0a04307830311a053078313131121d0a04307830310a0430783032120230781a0530783232322204307831611a033078312204437261623801501a",
+		hex.EncodeToString(proto))
+	decoded, err = UnmarshalEventProto(proto)
+	assert.NoError(t, err)
+	assert.Equal(t, event, decoded)
+
+	event.SchemaVersion = 2
+	_, err = UnmarshalEventProto(event.MarshalProto())
+	assert.ErrorContains(t, err, "schema version 2")
+}
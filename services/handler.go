@@ -0,0 +1,87 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Handler handles the events of one contract name.
+type Handler func(ctx context.Context, event *Event) error
+
+// Handle registers handler for the events of the contracts called name in ContractsName. Names are
+// matched case-insensitively. Once any handler is registered, Check requires one for every contract
+// name and HandlerSink becomes the Sink.
+func (s *ScanEventsOptions) Handle(name string, handler Handler) {
+	if s.Handlers == nil {
+		s.Handlers = make(map[string]Handler)
+	}
+	s.Handlers[strings.ToLower(name)] = handler
+}
+
+// checkHandlers fails on handlers without a contract and contracts without a handler, so a typo
+// stops the scanner at startup instead of dropping events. CallbackMethodPrefix defaults to the
+// handled names and must match them when set.
+func (s *ScanEventsOptions) checkHandlers() error {
+	if len(s.Handlers) == 0 {
+		return nil
+	}
+	if _, ok := s.Sink.(HandlerSink); s.Sink != nil && !ok {
+		return errors.New("Handlers and Sink cannot both be set")
+	}
+	handlers := make(map[string]Handler, len(s.Handlers))
+	for name, handler := range s.Handlers {
+		if handler == nil {
+			return fmt.Errorf("handler %s is nil", name)
+		}
+		handlers[strings.ToLower(name)] = handler
+	}
+	contracts := make(map[string]struct{})
+	for address, name := range s.ContractsName {
+		key := strings.ToLower(name.String())
+		if _, ok := handlers[key]; !ok {
+			return fmt.Errorf("contract %s %s has no handler", name, address)
+		}
+		contracts[key] = struct{}{}
+	}
+	names := make([]string, 0, len(handlers))
+	for name := range handlers {
+		if _, ok := contracts[name]; !ok {
+			return fmt.Errorf("handler %s has no contract in ContractsName", name)
+		}
+		names = append(names, name)
+	}
+	if len(s.CallbackMethodPrefix) == 0 {
+		sort.Strings(names)
+		s.CallbackMethodPrefix = names
+	}
+	prefixes := make(map[string]struct{}, len(s.CallbackMethodPrefix))
+	for _, prefix := range s.CallbackMethodPrefix {
+		if _, ok := handlers[strings.ToLower(prefix)]; !ok {
+			return fmt.Errorf("CallbackMethodPrefix %s has no handler", prefix)
+		}
+		prefixes[strings.ToLower(prefix)] = struct{}{}
+	}
+	for _, name := range names {
+		if _, ok := prefixes[name]; !ok {
+			return fmt.Errorf("handler %s is missing from CallbackMethodPrefix", name)
+		}
+	}
+	s.Handlers = handlers
+	s.Sink = HandlerSink(handlers)
+	return nil
+}
+
+// HandlerSink calls the Handler of the contract name of each event, keyed in lower case.
+type HandlerSink map[string]Handler
+
+func (h HandlerSink) Send(ctx context.Context, fb *FilterBlock) error {
+	handler, ok := h[strings.ToLower(fb.ContractName)]
+	if !ok {
+		return Permanent(fmt.Errorf("no handler for contract %s", fb.ContractName))
+	}
+	return handler(ctx, fb.Event())
+}
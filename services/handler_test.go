@@ -0,0 +1,55 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandlers(t *testing.T) {
+	handler := func(context.Context, *Event) error { return nil }
+	options := func() ScanEventsOptions {
+		return ScanEventsOptions{
+			ChainIoV2:     AdaptChainIo(nil),
+			Chain:         "Crab",
+			GetStartBlock: func() uint64 { return 0 },
+			SetStartBlock: func(uint64) {},
+			ContractsName: map[ContractsAddress]ContractsName{"0x111": "Apostle", "0x222": "objectOwnership"},
+		}
+	}
+
+	opt := options()
+	opt.Handle("apostle", handler)
+	opt.Handle("ObjectOwnership", handler)
+	assert.NoError(t, opt.Check())
+	assert.Equal(t, []string{"apostle", "objectownership"}, opt.CallbackMethodPrefix)
+	assert.IsType(t, HandlerSink{}, opt.Sink)
+	// checked again when the scanner is started
+	assert.NoError(t, opt.Check())
+
+	opt = options()
+	opt.Handle("apostle", handler)
+	assert.EqualError(t, opt.Check(), "contract objectOwnership 0x222 has no handler")
+
+	opt = options()
+	opt.Handle("apostle", handler)
+	opt.Handle("objectOwnership", handler)
+	opt.Handle("apostel", handler)
+	assert.EqualError(t, opt.Check(), "handler apostel has no contract in ContractsName")
+
+	opt = options()
+	opt.Handle("apostle", handler)
+	opt.Handle("objectOwnership", handler)
+	opt.CallbackMethodPrefix = []string{"Apostle"}
+	assert.EqualError(t, opt.Check(), "handler objectownership is missing from CallbackMethodPrefix")
+
+	opt = options()
+	opt.Handle("apostle", handler)
+	opt.Handle("objectOwnership", handler)
+	opt.Sink = WorkersSink{}
+	assert.Error(t, opt.Check())
+
+	err := HandlerSink{}.Send(context.Background(), &FilterBlock{ContractName: "apostle", Receipts: &Receipts{}})
+	assert.True(t, IsPermanent(err))
+}
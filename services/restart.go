@@ -0,0 +1,76 @@
+package services
+
+import (
+	"math/rand"
+	"time"
+)
+
+// RestartPolicy controls how a scanner started with RunForever is restarted after it fails.
+type RestartPolicy struct {
+	// InitialBackoff is the delay before the first restart. Default 1s
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between restarts. Default 1m
+	MaxBackoff time.Duration
+	// Multiplier grows the delay after each consecutive failure. Default 2
+	Multiplier float64
+	// Jitter randomizes each delay by up to ±Jitter of its value, in [0, 1]
+	Jitter float64
+	// MaxRestarts is the number of restarts allowed within Window before giving up. 0 means no limit
+	MaxRestarts int
+	// Window is the period MaxRestarts is counted over. Default 10m
+	Window time.Duration
+}
+
+func (r *RestartPolicy) setDefaults() {
+	if r.InitialBackoff <= 0 {
+		r.InitialBackoff = time.Second
+	}
+	if r.MaxBackoff <= 0 {
+		r.MaxBackoff = time.Minute
+	}
+	if r.MaxBackoff < r.InitialBackoff {
+		r.MaxBackoff = r.InitialBackoff
+	}
+	if r.Multiplier < 1 {
+		r.Multiplier = 2
+	}
+	if r.Jitter < 0 {
+		r.Jitter = 0
+	}
+	if r.Jitter > 1 {
+		r.Jitter = 1
+	}
+	if r.Window <= 0 {
+		r.Window = 10 * time.Minute
+	}
+}
+
+// Backoff returns the delay before restart number attempt, starting at 1.
+func (r RestartPolicy) Backoff(attempt int) time.Duration {
+	d := float64(r.InitialBackoff)
+	for i := 1; i < attempt && d < float64(r.MaxBackoff); i++ {
+		d *= r.Multiplier
+	}
+	if d > float64(r.MaxBackoff) {
+		d = float64(r.MaxBackoff)
+	}
+	if r.Jitter > 0 {
+		d += d * r.Jitter * (rand.Float64()*2 - 1)
+	}
+	return time.Duration(d)
+}
+
+// Allow reports whether another restart is allowed at now, given the times of earlier restarts.
+// It returns the restarts that are still within Window.
+func (r RestartPolicy) Allow(restarts []time.Time, now time.Time) (bool, []time.Time) {
+	var recent []time.Time
+	for _, t := range restarts {
+		if now.Sub(t) < r.Window {
+			recent = append(recent, t)
+		}
+	}
+	if r.MaxRestarts > 0 && len(recent) >= r.MaxRestarts {
+		return false, recent
+	}
+	return true, recent
+}
@@ -9,7 +9,6 @@ import (
 	"time"
 
 	"github.com/evolutionlandorg/block-scan/util/log"
-	"github.com/google/uuid"
 	"github.com/itering/go-workers"
 	"github.com/pkg/errors"
 )
@@ -23,6 +22,7 @@ type (
 
 type GetCallbackFunc func(tx string, blockTimestamp uint64, receipt *Receipts) interface{}
 type BeforePushFunc func(tx string, BlockTimestamp uint64, receipt *Receipts) bool
+type AfterPushFunc func(tx string, BlockTimestamp uint64, receipt *Receipts)
 
 type ChainIo interface {
 	ReceiptLog(tx string) (*Receipts, error)
@@ -36,6 +36,13 @@ type Tnx struct {
 	Tx             string
 	BlockTimestamp uint64
 	Contract       string
+	BlockNumber    uint64
+	// SkipCheckpoint is set for transactions that are not tracked by the checkpoint, such as rescans
+	SkipCheckpoint bool
+	// Attempts is how many times the receipt has been fetched without success
+	Attempts int
+	// Generation is how many times the scanner had rewound on a reorg when the transaction was found
+	Generation uint64
 }
 
 type Receipts struct {
@@ -54,15 +61,22 @@ type Log struct {
 	Topics  []string `json:"topics"`
 	Data    string   `json:"data"`
 	Address string   `json:"address"`
+	// LogIndex is the hex encoded index of the log in the block, empty if the chain does not report it
+	LogIndex string `json:"logIndex"`
 }
 
 type BlockHeader struct {
 	BlockTimeStamp uint64
 	Hash           string
+	ParentHash     string
+	// LogsBloom is the hex encoded logs bloom of the block, empty if the chain has none
+	LogsBloom string
 }
 
 type ScanEventsOptions struct {
-	ChainIo              ChainIo
+	ChainIo ChainIo
+	// ChainIoV2 is used by the scanners. Default ChainIo wrapped with AdaptChainIo
+	ChainIoV2            ChainIoV2
 	Chain                string
 	ContractsName        map[ContractsAddress]ContractsName
 	SleepTime            time.Duration
@@ -71,35 +85,163 @@ type ScanEventsOptions struct {
 	InitBlock            uint64
 	RunForever           bool
 	BeforePushMiddleware []BeforePushFunc
-	GetStartBlock        func() uint64
-	SetStartBlock        func(currentBlockNum uint64)
+	// AfterPushMiddleware is called once a transaction passed BeforePushMiddleware and every event of it was sent
+	AfterPushMiddleware []AfterPushFunc
+	GetStartBlock       func() uint64
+	SetStartBlock       func(currentBlockNum uint64)
+	// RewindStartBlock stores a checkpoint below the current one, on a reorg or SetCheckpoint. Default SetStartBlock
+	RewindStartBlock func(currentBlockNum uint64)
+	// LoadStartBlock is used by the scanners instead of GetStartBlock when set, so a failing store
+	// stops the scanner with an error instead of blocking it
+	LoadStartBlock func(ctx context.Context) (uint64, error)
+	// CheckpointStore is used for the start block functions when neither GetStartBlock nor SetStartBlock is set
+	CheckpointStore CheckpointStore
+	// OnCaughtUp is called with the head block number each time the scanner has processed every block up to the chain head
+	OnCaughtUp func(blockNum uint64)
+	// RestartPolicy is used when RunForever is set
+	RestartPolicy RestartPolicy
+	// OnRestart is called before the scanner is restarted, with the error that stopped it and the consecutive failure count
+	OnRestart func(err error, attempt int)
+	// Control, if set, lets the scanner be paused, resumed, rescanned and moved while it runs
+	Control *Control
+	// CheckpointInterval is how often scanning progress is saved when the scanned blocks had no matching transactions. Default 30s
+	CheckpointInterval time.Duration
+	// Confirmations is how many blocks below the chain head a block must be before its events are delivered
+	Confirmations uint64
+	// OnReorg is called when a chain reorganization is detected, after the checkpoint has been rewound to fromBlock-1.
+	// orphanedTxs are the transactions found in the blocks that were replaced. The ones not delivered yet are dropped,
+	// so none of them is delivered after OnReorg. Setting it enables reorg detection, which needs ChainIo.BlockHeader
+	// to return ParentHash
+	OnReorg func(fromBlock, toBlock uint64, orphanedTxs []string)
+	// ReorgWindow is how many recent block hashes are kept for reorg detection. Default 64
+	ReorgWindow int
+	// TxQueueSize is the capacity of the queue between block scanning and receipt fetching in polling mode. Default 1000
+	TxQueueSize int
+	// MaxTxAttempts is how many times a receipt is fetched before the transaction is dead-lettered. Default 10.
+	// Sink errors are retried until the Sink accepts the events, unless they are permanent
+	MaxTxAttempts int
+	// TxRetryBackoff is the delay before the first receipt retry, it doubles after each attempt up to one minute. Default 1s
+	TxRetryBackoff time.Duration
+	// DeadLetterStore keeps the transactions that ran out of attempts. Default in memory
+	DeadLetterStore DeadLetterStore
+	// BloomFilter makes the polling scanner test the watched contract addresses and Topics against the
+	// BlockHeader.LogsBloom of each block and skip FilterTrans for blocks that cannot match. It needs a
+	// BlockHeader call per block, which is batched when ChainIoV2 implements BatchChainIo
+	BloomFilter bool
+	// Topics, if set, narrows the bloom filter to blocks that also have a log with one of these topics.
+	// Transactions are still matched by contract address only
+	Topics []string
+	// Sink receives the matched events. Default WorkersSink, or HandlerSink when Handlers are set
+	Sink Sink
+	// Handlers are the typed event handlers by contract name, registered with Handle. They replace
+	// GetCallbackFunc and its "<Name>Callback" methods
+	Handlers map[string]Handler
+	// Backfill is the block range scanned by the BACKFILL scan type
+	Backfill BackfillOptions
+}
+
+type BackfillOptions struct {
+	From uint64
+	To   uint64
+	// Workers is the number of block ranges fetched in parallel. Default 4
+	Workers int
+	// ChunkSize is the number of blocks in each range. Default 100
+	ChunkSize uint64
+	// GetStartBlock and SetStartBlock keep the resume point of the backfill, apart from the live
+	// checkpoint of the chain. It is the first block not backfilled yet, so 0 means nothing was
+	// done even when From is 0. Default the CheckpointStore under "<chain>:backfill:<from>-<to>",
+	// or memory when CheckpointStore is nil
+	GetStartBlock func() uint64
+	SetStartBlock func(currentBlockNum uint64)
+}
+
+// StartBlock returns the stored checkpoint through LoadStartBlock, or GetStartBlock if it is not set.
+func (s *ScanEventsOptions) StartBlock(ctx context.Context) (uint64, error) {
+	if s.LoadStartBlock != nil {
+		return s.LoadStartBlock(ctx)
+	}
+	return s.GetStartBlock(), nil
 }
 
 func (s *ScanEventsOptions) Check() error {
-	if s.ChainIo == nil {
+	if s.ChainIo == nil && s.ChainIoV2 == nil {
 		return errors.New("chainIo must be not nil")
 	}
+	if s.ChainIoV2 == nil {
+		s.ChainIoV2 = AdaptChainIo(s.ChainIo)
+	}
+	if s.GetStartBlock == nil && s.SetStartBlock == nil && s.CheckpointStore != nil {
+		c := NewStoreCheckpoint(s.CheckpointStore, s.Chain)
+		s.GetStartBlock, s.SetStartBlock, s.RewindStartBlock, s.LoadStartBlock = c.Get, c.Set, c.Rewind, c.Load
+	}
 	if s.GetStartBlock == nil {
 		return errors.New("GetStartBlock must be not nil")
 	}
 	if s.SetStartBlock == nil {
 		return errors.New("SetStartBlock must be not nil")
 	}
+	if s.RewindStartBlock == nil {
+		s.RewindStartBlock = s.SetStartBlock
+	}
 	if s.Chain == "" {
 		return errors.New("chain must be not nil")
 	}
 	if len(s.ContractsName) == 0 {
 		return errors.New("contractsName must be not nil")
 	}
-	if s.GetCallbackFunc == nil {
+	if err := s.checkHandlers(); err != nil {
+		return err
+	}
+	if s.GetCallbackFunc == nil && len(s.Handlers) == 0 {
 		return errors.New("getCallbackFunc must be not nil")
 	}
 	if s.SleepTime == 0 {
 		s.SleepTime = time.Second * 5
 	}
+	if s.CheckpointInterval <= 0 {
+		s.CheckpointInterval = 30 * time.Second
+	}
+	if s.ReorgWindow <= 0 {
+		s.ReorgWindow = 64
+	}
+	if s.TxQueueSize <= 0 {
+		s.TxQueueSize = 1000
+	}
+	if s.MaxTxAttempts <= 0 {
+		s.MaxTxAttempts = 10
+	}
+	if s.TxRetryBackoff <= 0 {
+		s.TxRetryBackoff = time.Second
+	}
+	if s.DeadLetterStore == nil {
+		s.DeadLetterStore = NewMemoryDeadLetterStore()
+	}
+	if s.Sink == nil {
+		s.Sink = WorkersSink{}
+	}
+	s.RestartPolicy.setDefaults()
 	return nil
 }
 
+// ConfirmedHead returns the newest block with enough confirmations at the given chain head, or 0 if there is none.
+func (s *ScanEventsOptions) ConfirmedHead(head uint64) uint64 {
+	if head <= s.Confirmations {
+		return 0
+	}
+	return head - s.Confirmations
+}
+
+// TxRetryDelay returns the delay before the receipt of a transaction is fetched again after attempts failures.
+func (s *ScanEventsOptions) TxRetryDelay(attempts int) time.Duration {
+	return RestartPolicy{InitialBackoff: s.TxRetryBackoff, MaxBackoff: time.Minute, Multiplier: 2}.Backoff(attempts)
+}
+
+func (s *ScanEventsOptions) CaughtUp(blockNum uint64) {
+	if s.OnCaughtUp != nil {
+		s.OnCaughtUp(blockNum)
+	}
+}
+
 type Scan interface {
 	Init(opt ScanEventsOptions) error
 	WipeBlock(ctx context.Context) error
@@ -112,6 +254,10 @@ type FilterBlock struct {
 	Receipts       *Receipts
 	BlockTimestamp uint64
 	Callback       interface{}
+	// Position is the index in Receipts.Logs of the first log of the contract
+	Position int
+	// LogIndex is the index in the block of the first log of the contract, see Log.BlockIndex
+	LogIndex uint64
 }
 
 func (c ContractsAddress) String() string {
@@ -122,43 +268,34 @@ func (c ContractsName) String() string {
 	return string(c)
 }
 
+// Do enqueues the Event of fb as a go-workers job on the "<chain>Process" queue, or calls the Tron
+// solidity callback directly and returns its error.
 func (fb *FilterBlock) Do() error {
-	var startTask = func(tx, contractName string, blockTimestamp uint64) map[string]interface{} {
-		taskId := uuid.New().String()
-		return map[string]interface{}{
-			"tx":              tx,
-			"contract_name":   contractName,
-			"task_id":         taskId,
-			"block_timestamp": blockTimestamp,
-			"chain":           fb.Receipts.ChainSource,
-			"receipts":        fb.Receipts,
-		}
-	}
-
 	if !fb.Receipts.Solidity {
-		fb.TronSolidityProcess()
-		return nil
+		return fb.TronSolidityProcess()
 	}
 	queueName := fmt.Sprintf("%sProcess", strings.ToLower(fb.Receipts.ChainSource))
-	_, err := workers.Enqueue(queueName, queueName, startTask(fb.Txid, fb.ContractName, fb.BlockTimestamp))
+	_, err := workers.Enqueue(queueName, queueName, fb.Event())
 	return err
 }
 
-func (fb *FilterBlock) TronSolidityProcess() {
+// TronSolidityProcess calls the "<ContractName>Callback" method of Callback. It returns the error of the
+// callback, except "tx exist" which means the transaction was already processed.
+func (fb *FilterBlock) TronSolidityProcess() error {
 	if fb.Callback == nil {
-		return
+		return nil
 	}
-	ecInstant := fb.Callback
-	wReflect := reflect.ValueOf(&ecInstant).Elem()
 	methodName := fmt.Sprintf("%sCallback", fb.ContractName)
-	methodFunc := wReflect.MethodByName(methodName)
+	methodFunc := reflect.ValueOf(fb.Callback).MethodByName(methodName)
 	if !methodFunc.IsValid() {
-		return
+		log.Warn("%s callback %T has no %s method, the event of %s is dropped", fb.Receipts.ChainSource, fb.Callback, methodName, fb.Txid)
+		return nil
 	}
 	res := methodFunc.Call([]reflect.Value{reflect.ValueOf(context.Background())})
 	if v := res[0].Interface(); v != nil {
 		if err, ok := v.(error); ok && !strings.EqualFold(err.Error(), "tx exist") {
-			log.DPanic("Process error. %s", err)
+			return fmt.Errorf("%s %s %s: %w", fb.Receipts.ChainSource, methodName, fb.Txid, err)
 		}
 	}
+	return nil
 }
@@ -0,0 +1,38 @@
+package services
+
+import (
+	"context"
+)
+
+// Sink receives the matched events of the scanners, one FilterBlock per transaction and contract.
+// A Sink that returns an error gets the transaction again later, so delivery is at least once.
+type Sink interface {
+	Send(ctx context.Context, fb *FilterBlock) error
+}
+
+// WorkersSink enqueues each event as a go-workers job on the "<chain>Process" queue, or calls the
+// Tron solidity callback directly. It is the default Sink.
+type WorkersSink struct{}
+
+func (WorkersSink) Send(_ context.Context, fb *FilterBlock) error {
+	return fb.Do()
+}
+
+// ChanSink sends the events to a channel. Send blocks until the event is received or ctx is done.
+type ChanSink chan<- *FilterBlock
+
+func (c ChanSink) Send(ctx context.Context, fb *FilterBlock) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case c <- fb:
+		return nil
+	}
+}
+
+// SinkFunc is a function used as a Sink.
+type SinkFunc func(ctx context.Context, fb *FilterBlock) error
+
+func (f SinkFunc) Send(ctx context.Context, fb *FilterBlock) error {
+	return f(ctx, fb)
+}
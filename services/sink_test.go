@@ -0,0 +1,34 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type solidityCallback struct {
+	err error
+}
+
+func (c *solidityCallback) ApostleCallback(context.Context) error {
+	return c.err
+}
+
+func TestWorkersSinkSolidityCallback(t *testing.T) {
+	send := func(err error) error {
+		return WorkersSink{}.Send(context.Background(), &FilterBlock{
+			ContractName: "Apostle",
+			Txid:         "0x1",
+			Receipts:     &Receipts{ChainSource: "Tron"},
+			Callback:     &solidityCallback{err: err},
+		})
+	}
+	assert.NoError(t, send(nil))
+	// already processed
+	assert.NoError(t, send(errors.New("tx exist")))
+
+	failed := errors.New("db down")
+	assert.ErrorIs(t, send(failed), failed)
+}
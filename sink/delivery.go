@@ -0,0 +1,73 @@
+package sink
+
+import (
+	"sync"
+	"time"
+)
+
+// Delivery is one attempt to deliver an event to a URL.
+type Delivery struct {
+	EventID string
+	URL     string
+	Attempt int
+	// Status is the HTTP status of the response, 0 if there was none
+	Status int
+	Error  string
+	Time   time.Time
+}
+
+// Acknowledged reports whether the URL accepted the event.
+func (d Delivery) Acknowledged() bool {
+	return d.Status >= 200 && d.Status < 300
+}
+
+// DeliveryLog keeps the delivery attempts of each event.
+type DeliveryLog interface {
+	Add(d Delivery) error
+	List(eventID string) ([]Delivery, error)
+}
+
+// DefaultMaxEvents is how many events a MemoryDeliveryLog keeps when no limit is given
+const DefaultMaxEvents = 10000
+
+// MemoryDeliveryLog keeps the deliveries of the last maxEvents events in memory. Once it is full,
+// adding an event forgets the oldest one, so a URL that acknowledged the forgotten event is posted
+// to again if the event is sent again.
+type MemoryDeliveryLog struct {
+	mu         sync.Mutex
+	maxEvents  int
+	deliveries map[string][]Delivery
+	// order is a ring of the event IDs by first delivery, oldest is the next one to be replaced
+	order  []string
+	oldest int
+}
+
+// NewMemoryDeliveryLog returns a log of at most maxEvents events, DefaultMaxEvents if maxEvents is not positive.
+func NewMemoryDeliveryLog(maxEvents int) *MemoryDeliveryLog {
+	if maxEvents <= 0 {
+		maxEvents = DefaultMaxEvents
+	}
+	return &MemoryDeliveryLog{maxEvents: maxEvents, deliveries: make(map[string][]Delivery)}
+}
+
+func (m *MemoryDeliveryLog) Add(d Delivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.deliveries[d.EventID]; !ok {
+		if len(m.order) < m.maxEvents {
+			m.order = append(m.order, d.EventID)
+		} else {
+			delete(m.deliveries, m.order[m.oldest])
+			m.order[m.oldest] = d.EventID
+			m.oldest = (m.oldest + 1) % m.maxEvents
+		}
+	}
+	m.deliveries[d.EventID] = append(m.deliveries[d.EventID], d)
+	return nil
+}
+
+func (m *MemoryDeliveryLog) List(eventID string) ([]Delivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Delivery(nil), m.deliveries[eventID]...), nil
+}
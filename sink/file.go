@@ -0,0 +1,133 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/evolutionlandorg/block-scan/services"
+)
+
+type FileOptions struct {
+	// Dir is where the files are written
+	Dir string
+	// Prefix starts every file name. Default "events"
+	Prefix string
+	// Interval starts a new file at each multiple of it in UTC. Default 24h
+	Interval time.Duration
+	// MaxBytes starts a new file before one would grow beyond it. Default 100MB
+	MaxBytes int64
+}
+
+// FileEvent is one line of the files written by File.
+type FileEvent struct {
+	services.Event
+	WrittenAt time.Time `json:"written_at"`
+}
+
+// File is a services.Sink that appends each event as a FileEvent line to rotating JSON-lines files
+// named "<prefix>-<interval start>-<n>.jsonl", which sort in the order they were written.
+type File struct {
+	opt FileOptions
+	now func() time.Time
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	period time.Time
+	seq    int
+}
+
+var _ services.Sink = (*File)(nil)
+
+func NewFile(opt FileOptions) (*File, error) {
+	if opt.Dir == "" {
+		return nil, errors.New("file sink dir must be not empty")
+	}
+	if opt.Prefix == "" {
+		opt.Prefix = "events"
+	}
+	if opt.Interval <= 0 {
+		opt.Interval = 24 * time.Hour
+	}
+	if opt.MaxBytes <= 0 {
+		opt.MaxBytes = 100 << 20
+	}
+	if err := os.MkdirAll(opt.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &File{opt: opt, now: time.Now}, nil
+}
+
+func (f *File) Send(_ context.Context, fb *services.FilterBlock) error {
+	line, err := json.Marshal(FileEvent{Event: *fb.Event(), WrittenAt: f.now().UTC()})
+	if err != nil {
+		return services.Permanent(err)
+	}
+	line = append(line, '\n')
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.rotate(int64(len(line))); err != nil {
+		return err
+	}
+	n, err := f.file.Write(line)
+	f.size += int64(n)
+	return err
+}
+
+// rotate opens the file the next n bytes go to. It must be called with f.mu held.
+func (f *File) rotate(n int64) error {
+	period := f.now().UTC().Truncate(f.opt.Interval)
+	if f.file != nil && period.Equal(f.period) && (f.size == 0 || f.size+n <= f.opt.MaxBytes) {
+		return nil
+	}
+	if !period.Equal(f.period) {
+		f.period, f.seq = period, 0
+	} else if f.file != nil {
+		f.seq++
+	}
+	if err := f.close(); err != nil {
+		return err
+	}
+	for {
+		name := filepath.Join(f.opt.Dir, fmt.Sprintf("%s-%s-%03d.jsonl", f.opt.Prefix, period.Format("20060102T150405Z"), f.seq))
+		file, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			_ = file.Close()
+			return err
+		}
+		// left by an earlier run
+		if info.Size() > 0 && info.Size()+n > f.opt.MaxBytes {
+			_ = file.Close()
+			f.seq++
+			continue
+		}
+		f.file, f.size = file, info.Size()
+		return nil
+	}
+}
+
+func (f *File) close() error {
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.close()
+}
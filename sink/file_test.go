@@ -0,0 +1,99 @@
+package sink
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/evolutionlandorg/block-scan/metrics"
+	"github.com/evolutionlandorg/block-scan/scan"
+	"github.com/evolutionlandorg/block-scan/services"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileReplay(t *testing.T) {
+	dir := t.TempDir()
+	f, err := NewFile(FileOptions{Dir: dir, MaxBytes: 1000})
+	assert.NoError(t, err)
+	now := time.Date(2024, 5, 1, 23, 0, 0, 0, time.UTC)
+	f.now = func() time.Time { return now }
+
+	send := func(tx string, contracts ...string) {
+		for _, contract := range contracts {
+			assert.NoError(t, f.Send(context.Background(), &services.FilterBlock{
+				ContractName:   contract,
+				Txid:           tx,
+				BlockTimestamp: 1000,
+				Receipts: &services.Receipts{
+					BlockNumber: "12",
+					ChainSource: "Crab",
+					Status:      "0x1",
+					Logs: []services.Log{
+						{Address: "0x222", Topics: []string{"0x01"}, Data: tx},
+						{Address: "0x333", Topics: []string{"0x02"}, Data: tx},
+					},
+				},
+			}))
+		}
+	}
+	send("0xa1", "Transfer", "Apostle")
+	send("0xa2", "Transfer")
+	now = now.Add(2 * time.Hour)
+	send("0xa3", "Transfer")
+	assert.NoError(t, f.Close())
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	assert.Equal(t, []string{
+		filepath.Join(dir, "events-20240501T000000Z-000.jsonl"),
+		filepath.Join(dir, "events-20240501T000000Z-001.jsonl"),
+		filepath.Join(dir, "events-20240502T000000Z-000.jsonl"),
+	}, files)
+	data, _ := os.ReadFile(files[2])
+	assert.Contains(t, string(data), `"task_id":"Crab:12:0xa3:0","chain":"Crab","block_number":12,"tx":"0xa3","position":0,"contract_name":"Transfer","block_timestamp":1000,`)
+	assert.Contains(t, string(data), `"written_at":"2024-05-02T01:00:00Z"`)
+
+	var delivered []*services.FilterBlock
+	p := new(scan.Polling)
+	p.SetMetrics(metrics.NewMetrics())
+	assert.NoError(t, p.Init(services.ScanEventsOptions{
+		ChainIoV2:     services.AdaptChainIo(nil),
+		Chain:         "Crab",
+		GetStartBlock: func() uint64 { return 0 },
+		SetStartBlock: func(uint64) {},
+		ContractsName: map[services.ContractsAddress]services.ContractsName{
+			"0x222": "Transfer",
+			"0x333": "Apostle",
+		},
+		CallbackMethodPrefix: []string{"Transfer", "Apostle"},
+		GetCallbackFunc:      func(string, uint64, *services.Receipts) interface{} { return nil },
+		Sink: services.SinkFunc(func(_ context.Context, fb *services.FilterBlock) error {
+			delivered = append(delivered, fb)
+			return nil
+		}),
+	}))
+	replay, err := NewReplaySource(filepath.Join(dir, "events-*.jsonl"))
+	assert.NoError(t, err)
+	n, err := replay.Replay(context.Background(), p)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Len(t, delivered, 6)
+	assert.Equal(t, "0xa1", delivered[0].Txid)
+	assert.Equal(t, "Transfer", delivered[0].ContractName)
+	assert.Equal(t, "Apostle", delivered[1].ContractName)
+	assert.Equal(t, "Crab:12:0xa1:1", delivered[1].Event().ID)
+	assert.Equal(t, "0x1", delivered[0].Receipts.Status)
+	assert.Equal(t, "0xa3", delivered[5].Receipts.Logs[0].Data)
+
+	// a file of a newer schema is not replayed
+	newer := filepath.Join(dir, "events-20240503T000000Z-000.jsonl")
+	assert.NoError(t, os.WriteFile(newer, []byte(`{"schema_version":2,"task_id":"Crab:13:0xa4:0","chain":"Crab","tx":"0xa4","receipts":{}}`+"\n"), 0o644))
+	delivered = nil
+	replay, err = NewReplaySource(filepath.Join(dir, "events-*.jsonl"))
+	assert.NoError(t, err)
+	n, err = replay.Replay(context.Background(), p)
+	assert.ErrorContains(t, err, newer+" line 1: event Crab:13:0xa4:0 schema version 2")
+	assert.Equal(t, 3, n)
+	assert.Len(t, delivered, 6)
+}
@@ -0,0 +1,91 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/evolutionlandorg/block-scan/services"
+)
+
+// Distributor is the part of a scanner events are replayed into, such as *scan.Polling.
+type Distributor interface {
+	ReceiptDistribution(ctx context.Context, tx string, blockTimestamp uint64, receipt *services.Receipts) error
+}
+
+// ReplaySource reads the files written by File and feeds their events back through a scanner's
+// ReceiptDistribution, so they reach the callbacks and the Sink of the scanner again. The scanner
+// only needs Init, its ChainIo is never called.
+type ReplaySource struct {
+	Files []string
+}
+
+// NewReplaySource replays the files matching the glob pattern in name order, which is the order File wrote them.
+func NewReplaySource(pattern string) (*ReplaySource, error) {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files match %s", pattern)
+	}
+	sort.Strings(files)
+	return &ReplaySource{Files: files}, nil
+}
+
+// Replay distributes every transaction in the files once. File writes a line per contract of a
+// transaction while ReceiptDistribution covers all of them, so later lines of the same transaction are
+// skipped. A line of another schema version stops the replay with an error. It returns how many
+// transactions were replayed.
+func (r *ReplaySource) Replay(ctx context.Context, d Distributor) (int, error) {
+	var (
+		replayed int
+		seen     = make(map[string]struct{})
+	)
+	for _, name := range r.Files {
+		n, err := r.replayFile(ctx, name, d, seen)
+		replayed += n
+		if err != nil {
+			return replayed, err
+		}
+	}
+	return replayed, nil
+}
+
+func (r *ReplaySource) replayFile(ctx context.Context, name string, d Distributor, seen map[string]struct{}) (int, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	var replayed int
+	decoder := json.NewDecoder(file)
+	for line := 1; ; line++ {
+		if err := ctx.Err(); err != nil {
+			return replayed, err
+		}
+		var event FileEvent
+		if err := decoder.Decode(&event); errors.Is(err, io.EOF) {
+			return replayed, nil
+		} else if err != nil {
+			return replayed, fmt.Errorf("%s line %d: %w", name, line, err)
+		}
+		if err := event.CheckVersion(); err != nil {
+			return replayed, fmt.Errorf("%s line %d: %w", name, line, err)
+		}
+		key := event.Chain + ":" + event.Tx
+		if _, ok := seen[key]; ok || event.Receipts == nil {
+			continue
+		}
+		seen[key] = struct{}{}
+		if err := d.ReceiptDistribution(ctx, event.Tx, event.BlockTimestamp, event.Receipts); err != nil {
+			return replayed, fmt.Errorf("%s line %d: %w", name, line, err)
+		}
+		replayed++
+	}
+}
@@ -0,0 +1,168 @@
+// Package sink has services.Sink implementations that deliver events out of the process.
+package sink
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/evolutionlandorg/block-scan/services"
+	"github.com/evolutionlandorg/block-scan/util/log"
+)
+
+const (
+	// SignatureHeader holds "sha256=" and the hex HMAC-SHA256 of the request body
+	SignatureHeader = "X-Block-Scan-Signature"
+	// EventHeader holds the services.Event ID
+	EventHeader = "X-Block-Scan-Event"
+)
+
+type WebhookOptions struct {
+	// URLs are the endpoints every event is posted to
+	URLs []string
+	// Secret is the HMAC key of the SignatureHeader
+	Secret []byte
+	// MaxAttempts is how many times Send tries each URL. Default 5
+	MaxAttempts int
+	// InitialBackoff is the delay before the second attempt, it doubles after each attempt up to MaxBackoff. Default 1s
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between attempts. Default 1m
+	MaxBackoff time.Duration
+	// Timeout is the timeout of each request. Default 10s
+	Timeout time.Duration
+	// Client sends the requests. Default http.DefaultClient
+	Client *http.Client
+	// DeliveryLog keeps the attempts of each event. Default in memory, for the last DefaultMaxEvents events
+	DeliveryLog DeliveryLog
+}
+
+// Webhook is a services.Sink that posts the JSON of each services.Event, signed, to its URLs. An event is
+// acknowledged by a 2xx response. Send returns once every URL acknowledged the event, or with an error
+// when a URL is still failing after MaxAttempts, so the scanner sends the event again later. URLs that
+// already acknowledged an event are skipped when it is sent again.
+type Webhook struct {
+	opt WebhookOptions
+}
+
+var _ services.Sink = (*Webhook)(nil)
+
+func NewWebhook(opt WebhookOptions) (*Webhook, error) {
+	if len(opt.URLs) == 0 {
+		return nil, errors.New("webhook URLs must be not empty")
+	}
+	if len(opt.Secret) == 0 {
+		return nil, errors.New("webhook secret must be not empty")
+	}
+	if opt.MaxAttempts <= 0 {
+		opt.MaxAttempts = 5
+	}
+	if opt.InitialBackoff <= 0 {
+		opt.InitialBackoff = time.Second
+	}
+	if opt.MaxBackoff <= 0 {
+		opt.MaxBackoff = time.Minute
+	}
+	if opt.Timeout <= 0 {
+		opt.Timeout = 10 * time.Second
+	}
+	if opt.Client == nil {
+		opt.Client = http.DefaultClient
+	}
+	if opt.DeliveryLog == nil {
+		opt.DeliveryLog = NewMemoryDeliveryLog(0)
+	}
+	return &Webhook{opt: opt}, nil
+}
+
+func (w *Webhook) Send(ctx context.Context, fb *services.FilterBlock) error {
+	event := fb.Event()
+	body, err := json.Marshal(event)
+	if err != nil {
+		return services.Permanent(err)
+	}
+	mac := hmac.New(sha256.New, w.opt.Secret)
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	var errs []error
+	for _, url := range w.opt.URLs {
+		if err := w.deliver(ctx, event.ID, url, body, signature); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// deliver posts the event to url until it is acknowledged or MaxAttempts is reached. Attempts are
+// numbered on from the ones already in the delivery log.
+func (w *Webhook) deliver(ctx context.Context, id, url string, body []byte, signature string) error {
+	deliveries, err := w.opt.DeliveryLog.List(id)
+	if err != nil {
+		return err
+	}
+	var attempt int
+	for _, d := range deliveries {
+		if d.URL != url {
+			continue
+		}
+		if d.Acknowledged() {
+			return nil
+		}
+		if d.Attempt > attempt {
+			attempt = d.Attempt
+		}
+	}
+	backoff := services.RestartPolicy{InitialBackoff: w.opt.InitialBackoff, MaxBackoff: w.opt.MaxBackoff, Multiplier: 2}
+	for i := 1; ; i++ {
+		status, err := w.post(ctx, id, url, body, signature)
+		d := Delivery{EventID: id, URL: url, Attempt: attempt + i, Status: status, Time: time.Now()}
+		if err == nil && !d.Acknowledged() {
+			err = fmt.Errorf("status %d", status)
+		}
+		if err != nil {
+			d.Error = err.Error()
+		}
+		if logErr := w.opt.DeliveryLog.Add(d); logErr != nil {
+			log.Warn("webhook add delivery of %s error: %v", id, logErr)
+		}
+		if err == nil {
+			return nil
+		}
+		if i >= w.opt.MaxAttempts || ctx.Err() != nil {
+			return fmt.Errorf("webhook %s event %s attempt %d: %w", url, id, d.Attempt, err)
+		}
+		log.Debug("webhook %s event %s attempt %d error: %v", url, id, d.Attempt, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff.Backoff(i)):
+		}
+	}
+}
+
+func (w *Webhook) post(ctx context.Context, id, url string, body []byte, signature string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, w.opt.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, signature)
+	req.Header.Set(EventHeader, id)
+	resp, err := w.opt.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
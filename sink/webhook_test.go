@@ -0,0 +1,127 @@
+package sink
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/evolutionlandorg/block-scan/services"
+	"github.com/stretchr/testify/assert"
+)
+
+var secret = []byte("secret")
+
+// newServer answers with the statuses in order, then 200, after checking the signature.
+func newServer(t *testing.T, statuses ...int) (*httptest.Server, *int32) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(body)
+		assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), r.Header.Get(SignatureHeader))
+
+		event, err := services.UnmarshalEvent(body)
+		assert.NoError(t, err)
+		assert.Equal(t, "Crab:12:0xa1:0", event.ID)
+		assert.Equal(t, event.ID, r.Header.Get(EventHeader))
+		assert.Equal(t, "0x222", event.Receipts.Logs[0].Address)
+
+		n := int(atomic.AddInt32(&calls, 1))
+		if n <= len(statuses) {
+			w.WriteHeader(statuses[n-1])
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func event() *services.FilterBlock {
+	return &services.FilterBlock{
+		ContractName:   "Transfer",
+		Txid:           "0xa1",
+		BlockTimestamp: 1000,
+		Receipts: &services.Receipts{
+			BlockNumber: "12",
+			ChainSource: "Crab",
+			Logs:        []services.Log{{Address: "0x222", Topics: []string{"0x01"}}},
+		},
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	server, calls := newServer(t, http.StatusServiceUnavailable, http.StatusBadRequest)
+	deliveries := NewMemoryDeliveryLog(0)
+	w, err := NewWebhook(WebhookOptions{URLs: []string{server.URL}, Secret: secret, InitialBackoff: time.Millisecond, DeliveryLog: deliveries})
+	assert.NoError(t, err)
+
+	assert.NoError(t, w.Send(context.Background(), event()))
+	assert.Equal(t, int32(3), atomic.LoadInt32(calls))
+	log, _ := deliveries.List("Crab:12:0xa1:0")
+	assert.Len(t, log, 3)
+	assert.Equal(t, http.StatusServiceUnavailable, log[0].Status)
+	assert.Equal(t, "status 400", log[1].Error)
+	assert.True(t, log[2].Acknowledged())
+	assert.Equal(t, 3, log[2].Attempt)
+
+	// acknowledged events are not posted again
+	assert.NoError(t, w.Send(context.Background(), event()))
+	assert.Equal(t, int32(3), atomic.LoadInt32(calls))
+}
+
+func TestWebhookAttempts(t *testing.T) {
+	good, goodCalls := newServer(t)
+	bad, badCalls := newServer(t, 500, 500, 500)
+	deliveries := NewMemoryDeliveryLog(0)
+	w, err := NewWebhook(WebhookOptions{
+		URLs:           []string{good.URL, bad.URL},
+		Secret:         secret,
+		MaxAttempts:    2,
+		InitialBackoff: time.Millisecond,
+		DeliveryLog:    deliveries,
+	})
+	assert.NoError(t, err)
+
+	err = w.Send(context.Background(), event())
+	assert.ErrorContains(t, err, "attempt 2: status 500")
+	assert.Equal(t, int32(1), atomic.LoadInt32(goodCalls))
+	assert.Equal(t, int32(2), atomic.LoadInt32(badCalls))
+
+	// sent again by the scanner, only the failing URL is posted to
+	assert.NoError(t, w.Send(context.Background(), event()))
+	assert.Equal(t, int32(1), atomic.LoadInt32(goodCalls))
+	assert.Equal(t, int32(4), atomic.LoadInt32(badCalls))
+	log, _ := deliveries.List("Crab:12:0xa1:0")
+	assert.Len(t, log, 5)
+	assert.Equal(t, 4, log[4].Attempt)
+
+	_, err = NewWebhook(WebhookOptions{URLs: []string{good.URL}})
+	assert.Error(t, err)
+}
+
+func TestMemoryDeliveryLogBounded(t *testing.T) {
+	deliveries := NewMemoryDeliveryLog(3)
+	for i := 0; i < 10; i++ {
+		for attempt := 1; attempt <= 2; attempt++ {
+			assert.NoError(t, deliveries.Add(Delivery{EventID: fmt.Sprint(i), URL: "http://a", Attempt: attempt}))
+		}
+	}
+	assert.Len(t, deliveries.deliveries, 3)
+	assert.Len(t, deliveries.order, 3)
+	for i := 0; i < 10; i++ {
+		log, err := deliveries.List(fmt.Sprint(i))
+		assert.NoError(t, err)
+		if i < 7 {
+			assert.Empty(t, log)
+		} else {
+			assert.Len(t, log, 2)
+		}
+	}
+}
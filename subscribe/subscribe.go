@@ -18,7 +18,6 @@ import (
 	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/spf13/cast"
 )
 
 type Receipts struct {
@@ -30,27 +29,40 @@ type Receipts struct {
 
 type Subscribe struct {
 	*scan.Polling
-	metrics metrics.Metrics
-	wss     string
+	metrics  metrics.Metrics
+	wss      string
+	orphaned map[string]uint64
 }
 
 func (p *Subscribe) SetMetrics(metrics metrics.Metrics) {
 	p.metrics = metrics
+	if p.Polling != nil {
+		p.Polling.SetMetrics(metrics)
+	}
 }
 
 func (p *Subscribe) Init(opt services.ScanEventsOptions) error {
 	if p.Polling == nil {
 		p.Polling = new(scan.Polling)
+		p.Polling.SetMetrics(p.metrics)
 	}
 	wss := os.Getenv(fmt.Sprintf("%s_WSS_RPC", strings.ToUpper(opt.Chain)))
 	if !strings.HasPrefix(wss, "ws") || wss == "" {
 		return fmt.Errorf("check if %s_WSS_RPC is a valid websocket connection", strings.ToUpper(opt.Chain))
 	}
 	p.wss = wss
+	p.orphaned = make(map[string]uint64)
 	return p.Polling.Init(opt)
 }
 
-func (p *Subscribe) filterLogs(ctx context.Context, startBlock uint64, client *ethclient.Client) {
+// Endpoint returns the websocket endpoint read from {CHAIN}_WSS_RPC.
+func (p *Subscribe) Endpoint() string {
+	return p.wss
+}
+
+// filterLogs delivers the logs after startBlock up to the confirmed chain head and returns the last
+// block it scanned. It returns an error when a receipt cannot be fetched or the Sink keeps failing.
+func (p *Subscribe) filterLogs(ctx context.Context, startBlock uint64, client *ethclient.Client) (uint64, error) {
 	query := new(ethereum.FilterQuery)
 	for k := range p.Opt.ContractsName {
 		contractsAddress := strings.ToLower(k.String())
@@ -59,33 +71,54 @@ func (p *Subscribe) filterLogs(ctx context.Context, startBlock uint64, client *e
 	var (
 		data = make(map[string]*Receipts)
 	)
-	push := func() {
+	defer func() {
 		for _, v := range data {
-			result, err := util.TryReturn(func() (result interface{}, err error) {
-				resp, err := p.Opt.ChainIo.ReceiptLog(v.Tx)
-				if err != nil {
-					time.Sleep(time.Second)
-					return nil, err
-				}
-				return resp, nil
-			}, 10)
-			util.Panic(err)
-			data[v.Tx].Receipts = result.(*services.Receipts)
+			p.Checkpoint().Drop(v.BlockNumber)
+		}
+	}()
+	push := func() error {
+		txs := make([]string, 0, len(data))
+		for tx := range data {
+			txs = append(txs, tx)
+		}
+		prefetched := p.prefetch(ctx, txs)
+		for _, v := range data {
+			receipt, err := p.receiptLog(ctx, v.Tx, prefetched)
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("%s receipt of %s: %w", p.Opt.Chain, v.Tx, err)
+			}
+			data[v.Tx].Receipts = receipt
 			if data[v.Tx].Receipts == nil || len(data[v.Tx].Receipts.Logs) == 0 {
 				continue
 			}
-			if p.RunBeforePushMiddleware(v.Tx, v.Timestamp, data[v.Tx].Receipts) {
-				_ = p.ReceiptDistribution(v.Tx, v.Timestamp, data[v.Tx].Receipts)
-				p.Opt.SetStartBlock(cast.ToUint64(v.Receipts.BlockNumber))
+			delivered := p.Delivered != nil && p.Delivered(v.Tx)
+			if !delivered && p.RunBeforePushMiddleware(v.Tx, v.Timestamp, data[v.Tx].Receipts) {
+				err := p.Retry(ctx, func() error { return p.ReceiptDistribution(ctx, v.Tx, v.Timestamp, data[v.Tx].Receipts) })
+				if ctx.Err() != nil {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				p.RunAfterPushMiddleware(v.Tx, v.Timestamp, data[v.Tx].Receipts)
 			}
 			delete(data, v.Tx)
+			p.Checkpoint().Done(v.BlockNumber)
 		}
+		return nil
 	}
 
-	for {
-		endBlock, _ := client.BlockNumber(context.Background())
+	for ctx.Err() == nil {
+		endBlock, _ := client.BlockNumber(ctx)
+		endBlock = p.Opt.ConfirmedHead(endBlock)
 		if endBlock == 0 {
-			time.Sleep(time.Second)
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
 			continue
 		}
 		if endBlock <= startBlock {
@@ -96,7 +129,8 @@ func (p *Subscribe) filterLogs(ctx context.Context, startBlock uint64, client *e
 			endBlock = startBlock + 500
 		}
 
-		query.FromBlock = big.NewInt(int64(startBlock))
+		// startBlock is already done
+		query.FromBlock = big.NewInt(int64(startBlock + 1))
 		query.ToBlock = big.NewInt(int64(endBlock))
 		rawLogs, err := client.FilterLogs(ctx, *query)
 		if err != nil {
@@ -105,7 +139,7 @@ func (p *Subscribe) filterLogs(ctx context.Context, startBlock uint64, client *e
 		}
 
 		var (
-			blockNumber = make(map[uint64]uint64)
+			blockNumber = p.timestamps(ctx, rawLogs)
 		)
 
 		for _, v := range rawLogs {
@@ -126,15 +160,107 @@ func (p *Subscribe) filterLogs(ctx context.Context, startBlock uint64, client *e
 					Timestamp:   blockNumber[v.BlockNumber],
 					BlockNumber: v.BlockNumber,
 				}
+				p.Checkpoint().Add(v.BlockNumber)
 				p.metrics.ScanTxTotal(p.Opt.Chain)
 			}
 		}
-		push()
+		p.Checkpoint().Scanned(endBlock)
+		if err := push(); err != nil {
+			return startBlock, err
+		}
 		log.Debug("%s %d-%d block high filter logs %d", p.Opt.Chain, startBlock, endBlock, len(data))
 		startBlock = endBlock
+		p.Opt.Control.SetProgress(endBlock)
+	}
+	for len(data) > 0 && ctx.Err() == nil {
+		if err := push(); err != nil {
+			return startBlock, err
+		}
+	}
+	return startBlock, nil
+}
+
+// receiptLog returns the prefetched receipt of tx or fetches it, retrying while the error is retryable.
+func (p *Subscribe) receiptLog(ctx context.Context, tx string, prefetched map[string]*services.Receipts) (receipt *services.Receipts, err error) {
+	if receipt, ok := prefetched[tx]; ok {
+		return receipt, nil
+	}
+	err = p.Retry(ctx, func() (err error) {
+		receipt, err = p.Opt.ChainIoV2.ReceiptLog(ctx, tx)
+		return err
+	})
+	return receipt, err
+}
+
+// prefetch fetches the receipts of txs in one batch when the ChainIoV2 implements services.BatchChainIo.
+// Receipts that failed or are not available are left out.
+func (p *Subscribe) prefetch(ctx context.Context, txs []string) map[string]*services.Receipts {
+	batch, ok := p.Opt.ChainIoV2.(services.BatchChainIo)
+	if !ok || len(txs) < 2 {
+		return nil
+	}
+	receipts, err := batch.ReceiptLogs(ctx, txs)
+	prefetched := make(map[string]*services.Receipts, len(txs))
+	for i, tx := range txs {
+		if services.BatchErr(err, i) == nil && receipts[i] != nil {
+			prefetched[tx] = receipts[i]
+		}
+	}
+	return prefetched
+}
+
+// timestamps returns the timestamps of the blocks of logs fetched in one batch when the ChainIoV2
+// implements services.BatchChainIo. Blocks that failed are left out.
+func (p *Subscribe) timestamps(ctx context.Context, logs []types.Log) map[uint64]uint64 {
+	timestamps := make(map[uint64]uint64)
+	batch, ok := p.Opt.ChainIoV2.(services.BatchChainIo)
+	if !ok || len(logs) == 0 {
+		return timestamps
+	}
+	var nums []uint64
+	for _, v := range logs {
+		if _, ok := timestamps[v.BlockNumber]; !ok {
+			timestamps[v.BlockNumber] = 0
+			nums = append(nums, v.BlockNumber)
+		}
+	}
+	headers, err := batch.BlockHeaders(ctx, nums)
+	for i, num := range nums {
+		if services.BatchErr(err, i) == nil && headers[i] != nil {
+			timestamps[num] = headers[i].BlockTimeStamp
+		} else {
+			delete(timestamps, num)
+		}
+	}
+	return timestamps
+}
+
+// removed handles a log that was reverted by a chain reorganization. A transaction that is still
+// waiting to be pushed is dropped; one that was already delivered is reported through OnReorg
+// and the checkpoint is rewound to the block before it.
+func (p *Subscribe) removed(vLog types.Log, data map[string]*Receipts) {
+	tx := vLog.TxHash.Hex()
+	if v, ok := data[tx]; ok {
+		delete(data, tx)
+		p.Checkpoint().Done(v.BlockNumber)
+		return
+	}
+	if _, ok := p.orphaned[tx]; ok {
+		return
 	}
-	for len(data) > 0 {
-		push()
+	p.orphaned[tx] = vLog.BlockNumber
+	for k, v := range p.orphaned {
+		if v+uint64(p.Opt.ReorgWindow) < vLog.BlockNumber {
+			delete(p.orphaned, k)
+		}
+	}
+	log.Warn("%s chain reorganization removed %s at block %d", p.Opt.Chain, tx, vLog.BlockNumber)
+	if vLog.BlockNumber > 0 {
+		p.Checkpoint().Reset(vLog.BlockNumber - 1)
+		p.Opt.RewindStartBlock(vLog.BlockNumber - 1)
+	}
+	if p.Opt.OnReorg != nil {
+		p.Opt.OnReorg(vLog.BlockNumber, vLog.BlockNumber, []string{tx})
 	}
 }
 
@@ -149,14 +275,23 @@ func (p *Subscribe) WipeBlock(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	defer client.Close()
 
 	// 先筛选
-	currentBlockNum := p.Opt.GetStartBlock()
+	currentBlockNum, err := p.Opt.StartBlock(ctx)
+	if err != nil {
+		return err
+	}
 	if currentBlockNum == 0 {
 		currentBlockNum = p.Opt.InitBlock
 	}
+	p.Checkpoint().Reset(currentBlockNum)
 
-	p.filterLogs(ctx, currentBlockNum, client)
+	head, err := p.filterLogs(ctx, currentBlockNum, client)
+	if err != nil {
+		return err
+	}
+	p.Opt.CaughtUp(head)
 	log.Debug("%s start subscribe latest block info", p.Opt.Chain)
 
 	logs := make(chan types.Log)
@@ -164,52 +299,100 @@ func (p *Subscribe) WipeBlock(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	defer sub.Unsubscribe()
 
 	sleepTime := util.GetSleepTime()
 	waitTime := util.GetDelayTime()
 	t := time.NewTicker(sleepTime)
 	defer t.Stop()
 
-	data := make(map[string]*Receipts)
-	push := func() {
+	var (
+		data = make(map[string]*Receipts)
+		// newest is the highest block a log was received from
+		newest uint64
+	)
+	defer func() {
+		// whatever is not pushed yet is scanned again from the checkpoint next time
+		for _, v := range data {
+			p.Checkpoint().Drop(v.BlockNumber)
+		}
+	}()
+	push := func() error {
 		now := time.Now().Unix()
+		var confirmedHead uint64
+		if p.Opt.Confirmations > 0 {
+			head, err := client.BlockNumber(ctx)
+			if err != nil {
+				log.Warn("%s get block number error: %v", p.Opt.Chain, err)
+				return nil
+			}
+			confirmedHead = p.Opt.ConfirmedHead(head)
+		}
+		var ready []string
 		for key, v := range data {
 			if now-int64(v.Timestamp) < int64(waitTime.Seconds()) {
 				continue
 			}
-			result, err := util.TryReturn(func() (result interface{}, err error) {
-				resp, err := p.Opt.ChainIo.ReceiptLog(v.Tx)
-				if err != nil {
-					time.Sleep(time.Second)
-					return nil, err
-				}
-				return resp, nil
-			}, 10)
-			util.Panic(err)
-			data[key].Receipts = result.(*services.Receipts)
+			if p.Opt.Confirmations > 0 && v.BlockNumber > confirmedHead {
+				continue
+			}
+			ready = append(ready, key)
+		}
+		prefetched := p.prefetch(ctx, ready)
+		for _, key := range ready {
+			v := data[key]
+			receipt, err := p.receiptLog(ctx, v.Tx, prefetched)
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("%s receipt of %s: %w", p.Opt.Chain, v.Tx, err)
+			}
+			data[key].Receipts = receipt
 			if data[v.Tx].Receipts == nil || len(data[v.Tx].Receipts.Logs) == 0 {
 				continue
 			}
 			log.Debug("%s push %s %d logs to queue", p.Opt.Chain, v.Tx, len(v.Logs))
-			if p.RunBeforePushMiddleware(v.Tx, v.Timestamp, v.Receipts) {
-				_ = p.ReceiptDistribution(v.Tx, v.Timestamp, v.Receipts)
-				p.Opt.SetStartBlock(cast.ToUint64(v.Receipts.BlockNumber))
+			delivered := p.Delivered != nil && p.Delivered(v.Tx)
+			if !delivered && p.RunBeforePushMiddleware(v.Tx, v.Timestamp, v.Receipts) {
+				err := p.Retry(ctx, func() error { return p.ReceiptDistribution(ctx, v.Tx, v.Timestamp, v.Receipts) })
+				if ctx.Err() != nil {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				p.RunAfterPushMiddleware(v.Tx, v.Timestamp, v.Receipts)
 			}
+			p.Opt.Control.SetProgress(v.BlockNumber)
 			delete(data, key)
+			p.Checkpoint().Done(v.BlockNumber)
 		}
+		return nil
 	}
 
 	for {
 		select {
 		case err := <-sub.Err():
-			push()
+			if pushErr := push(); pushErr != nil {
+				return pushErr
+			}
 			return err
 		case <-ctx.Done():
 			sub.Unsubscribe()
-			push()
+			_ = push()
 			return nil
 		case vLog := <-logs:
 			tx := vLog.TxHash.Hex()
+			if vLog.Removed {
+				p.removed(vLog, data)
+				continue
+			}
+			// logs arrive in block order, so every log of the blocks before this one has been received
+			if vLog.BlockNumber > newest {
+				newest = vLog.BlockNumber
+				p.Checkpoint().Scanned(newest - 1)
+			}
 			if _, ok := data[tx]; !ok {
 				result, err := util.TryReturn(func() (result interface{}, err error) {
 					return client.BlockByNumber(ctx, big.NewInt(int64(vLog.BlockNumber)))
@@ -219,16 +402,38 @@ func (p *Subscribe) WipeBlock(ctx context.Context) error {
 				}
 				b := result.(*types.Block)
 				data[tx] = &Receipts{
-					Tx:        tx,
-					Timestamp: b.Time(),
+					Tx:          tx,
+					Timestamp:   b.Time(),
+					BlockNumber: vLog.BlockNumber,
 				}
+				p.Checkpoint().Add(vLog.BlockNumber)
 				p.metrics.ScanTxTotal(p.Opt.Chain, 1)
 			}
 		case <-t.C:
+			// keep collecting logs while paused, deliver them once resumed
+			if p.Opt.Control.Paused() {
+				continue
+			}
+			if err := p.HandleControl(ctx); err != nil {
+				continue
+			}
+			if blockNum, ok := p.Opt.Control.TakeCheckpoint(); ok {
+				if err := push(); err != nil {
+					return err
+				}
+				log.Info("%s checkpoint moved to %d", p.Opt.Chain, blockNum)
+				p.Checkpoint().Reset(blockNum)
+				if _, err := p.filterLogs(ctx, blockNum, client); err != nil {
+					return err
+				}
+			}
 			if len(data) <= 0 {
+				p.Checkpoint().Scanned(newest)
 				continue
 			}
-			push()
+			if err := push(); err != nil {
+				return err
+			}
 		}
 	}
 }
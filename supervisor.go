@@ -0,0 +1,175 @@
+package block_scan
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/evolutionlandorg/block-scan/services"
+	"github.com/evolutionlandorg/block-scan/util/log"
+)
+
+type ChainState string
+
+var (
+	ChainStateRunning  ChainState = "running"
+	ChainStateCrashed  ChainState = "crashed"
+	ChainStateCaughtUp ChainState = "caught-up"
+	ChainStateStopped  ChainState = "stopped"
+)
+
+type ChainStatus struct {
+	Chain     string
+	State     ChainState
+	Restarts  int
+	LastError error
+	// Since is when the chain entered its current state
+	Since time.Time
+	// BlockNum is the head block number reported by the last OnCaughtUp call
+	BlockNum uint64
+}
+
+// Supervisor runs one scanner per chain in its own goroutine and restarts
+// each of them independently according to its RestartPolicy,
+// so a failing chain does not affect the others.
+type Supervisor struct {
+	ScanType ScanType
+
+	opts   []services.ScanEventsOptions
+	mu     sync.RWMutex
+	status map[string]*ChainStatus
+	wg     sync.WaitGroup
+	cancel context.CancelFunc
+}
+
+func NewSupervisor(scanType ScanType, opts ...services.ScanEventsOptions) *Supervisor {
+	return &Supervisor{
+		ScanType: scanType,
+		opts:     opts,
+		status:   make(map[string]*ChainStatus),
+	}
+}
+
+// Start checks every chain's options and starts the scanners. It does not block.
+func (s *Supervisor) Start(ctx context.Context) error {
+	if _, err := newScanInstance(s.ScanType); err != nil {
+		return err
+	}
+	for i := range s.opts {
+		if err := s.opts[i].Check(); err != nil {
+			return fmt.Errorf("%s: %w", s.opts[i].Chain, err)
+		}
+		if _, ok := s.status[s.opts[i].Chain]; ok {
+			return fmt.Errorf("chain %s is configured more than once", s.opts[i].Chain)
+		}
+		s.status[s.opts[i].Chain] = &ChainStatus{Chain: s.opts[i].Chain, State: ChainStateStopped, Since: time.Now()}
+	}
+
+	ctx, s.cancel = context.WithCancel(ctx)
+	for _, opt := range s.opts {
+		s.wg.Add(1)
+		go s.supervise(ctx, opt)
+	}
+	return nil
+}
+
+// Wait blocks until every chain has stopped.
+func (s *Supervisor) Wait() {
+	s.wg.Wait()
+}
+
+// Stop stops every chain and waits for them to exit.
+func (s *Supervisor) Stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.Wait()
+}
+
+// Run starts the scanners and blocks until ctx is done and every chain has stopped.
+func (s *Supervisor) Run(ctx context.Context) error {
+	if err := s.Start(ctx); err != nil {
+		return err
+	}
+	s.Wait()
+	return nil
+}
+
+func (s *Supervisor) Status(chain string) (ChainStatus, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	status, ok := s.status[chain]
+	if !ok {
+		return ChainStatus{}, false
+	}
+	return *status, true
+}
+
+func (s *Supervisor) Statuses() []ChainStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var list []ChainStatus
+	for _, opt := range s.opts {
+		list = append(list, *s.status[opt.Chain])
+	}
+	return list
+}
+
+func (s *Supervisor) setState(chain string, state ChainState, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := s.status[chain]
+	if err != nil {
+		status.LastError = err
+	}
+	if status.State != state {
+		status.State = state
+		status.Since = time.Now()
+	}
+}
+
+func (s *Supervisor) caughtUp(chain string, blockNum uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := s.status[chain]
+	status.BlockNum = blockNum
+	if status.State == ChainStateRunning {
+		status.State = ChainStateCaughtUp
+		status.Since = time.Now()
+	}
+}
+
+func (s *Supervisor) supervise(ctx context.Context, opt services.ScanEventsOptions) {
+	defer s.wg.Done()
+
+	onCaughtUp := opt.OnCaughtUp
+	opt.OnCaughtUp = func(blockNum uint64) {
+		s.caughtUp(opt.Chain, blockNum)
+		if onCaughtUp != nil {
+			onCaughtUp(blockNum)
+		}
+	}
+	onRestart := opt.OnRestart
+	opt.OnRestart = func(err error, attempt int) {
+		s.mu.Lock()
+		s.status[opt.Chain].Restarts++
+		s.mu.Unlock()
+		s.setState(opt.Chain, ChainStateCrashed, err)
+		if onRestart != nil {
+			onRestart(err, attempt)
+		}
+	}
+
+	err := runForever(ctx, s.ScanType, opt, func() {
+		s.setState(opt.Chain, ChainStateRunning, nil)
+	})
+	if err != nil {
+		// the restart policy gave up; the chain stays crashed until the supervisor is started again
+		s.setState(opt.Chain, ChainStateCrashed, err)
+		log.Error("%s scanner stopped: %v", opt.Chain, err)
+		return
+	}
+	s.setState(opt.Chain, ChainStateStopped, nil)
+	log.Info("%s scanner finished", opt.Chain)
+}
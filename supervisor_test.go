@@ -0,0 +1,116 @@
+package block_scan
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/evolutionlandorg/block-scan/services"
+	"github.com/stretchr/testify/assert"
+)
+
+type BrokenChainIo struct {
+	MockChainIo
+}
+
+func (m *BrokenChainIo) BlockNumber() uint64 {
+	panic("rpc endpoint unavailable")
+}
+
+func TestSupervisor(t *testing.T) {
+	newOpt := func(chain string, chainIo services.ChainIo) services.ScanEventsOptions {
+		return services.ScanEventsOptions{
+			ChainIo:       chainIo,
+			GetStartBlock: func() uint64 { return 1 },
+			SetStartBlock: func(currentBlockNum uint64) {},
+			Chain:         chain,
+			ContractsName: map[services.ContractsAddress]services.ContractsName{
+				services.ContractsAddress("222"): services.ContractsName("fake"),
+			},
+			GetCallbackFunc: func(tx string, blockTimestamp uint64, receipt *services.Receipts) interface{} {
+				return new(FakeCallback)
+			},
+			CallbackMethodPrefix: []string{"Fake"},
+		}
+	}
+
+	heco := newOpt("Heco", new(BrokenChainIo))
+	heco.RestartPolicy = services.RestartPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	s := NewSupervisor(POLLING, newOpt("Crab", new(MockChainIo)), heco)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, s.Start(ctx))
+
+	assert.Eventually(t, func() bool {
+		crab, _ := s.Status("Crab")
+		heco, _ := s.Status("Heco")
+		return crab.State == ChainStateCaughtUp && heco.Restarts > 1
+	}, time.Second, 10*time.Millisecond)
+
+	status, ok := s.Status("Heco")
+	assert.True(t, ok)
+	assert.EqualError(t, status.LastError, "rpc endpoint unavailable")
+
+	s.Stop()
+	for _, status := range s.Statuses() {
+		assert.Equal(t, ChainStateStopped, status.State)
+	}
+}
+
+func TestSupervisorDuplicateChain(t *testing.T) {
+	opt := services.ScanEventsOptions{
+		ChainIo:       new(MockChainIo),
+		GetStartBlock: func() uint64 { return 1 },
+		SetStartBlock: func(currentBlockNum uint64) {},
+		Chain:         "Crab",
+		ContractsName: map[services.ContractsAddress]services.ContractsName{
+			services.ContractsAddress("222"): services.ContractsName("fake"),
+		},
+		GetCallbackFunc: func(tx string, blockTimestamp uint64, receipt *services.Receipts) interface{} {
+			return nil
+		},
+	}
+	assert.Error(t, NewSupervisor(POLLING, opt, opt).Start(context.Background()))
+	assert.Error(t, NewSupervisor("unknown", opt).Start(context.Background()))
+}
+
+func TestRunForeverGivesUp(t *testing.T) {
+	var attempts []int
+	err := StartScanChainEvents(context.Background(), POLLING, services.ScanEventsOptions{
+		ChainIo:       new(BrokenChainIo),
+		GetStartBlock: func() uint64 { return 1 },
+		SetStartBlock: func(currentBlockNum uint64) {},
+		Chain:         "Heco",
+		ContractsName: map[services.ContractsAddress]services.ContractsName{
+			services.ContractsAddress("222"): services.ContractsName("fake"),
+		},
+		GetCallbackFunc: func(tx string, blockTimestamp uint64, receipt *services.Receipts) interface{} {
+			return nil
+		},
+		RunForever: true,
+		RestartPolicy: services.RestartPolicy{
+			InitialBackoff: time.Millisecond,
+			MaxRestarts:    3,
+			Window:         time.Minute,
+		},
+		OnRestart: func(err error, attempt int) {
+			attempts = append(attempts, attempt)
+		},
+	})
+	assert.ErrorContains(t, err, "rpc endpoint unavailable")
+	assert.Equal(t, []int{1, 2, 3}, attempts)
+}
+
+func TestRestartPolicyBackoff(t *testing.T) {
+	policy := services.RestartPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second, Multiplier: 2}
+	assert.Equal(t, time.Second, policy.Backoff(1))
+	assert.Equal(t, 2*time.Second, policy.Backoff(2))
+	assert.Equal(t, 4*time.Second, policy.Backoff(3))
+	assert.Equal(t, 5*time.Second, policy.Backoff(10))
+
+	policy.Jitter = 0.5
+	for i := 0; i < 10; i++ {
+		d := policy.Backoff(1)
+		assert.True(t, d >= time.Second/2 && d <= time.Second*3/2, d)
+	}
+}